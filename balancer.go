@@ -0,0 +1,213 @@
+package typhon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/monzo/terrors"
+)
+
+// A BalancingStrategy determines how a load balanced Service chooses between the endpoints of a service.
+type BalancingStrategy int
+
+const (
+	// RoundRobin sends requests to each endpoint in turn.
+	RoundRobin BalancingStrategy = iota
+	// LeastOutstanding sends requests to the endpoint with the fewest requests in flight.
+	LeastOutstanding
+	// PowerOfTwoChoices sends requests to whichever of two endpoints chosen at random has fewer requests in flight.
+	PowerOfTwoChoices
+)
+
+// A BalancerPolicy configures LoadBalancedService.
+type BalancerPolicy struct {
+	// Resolver resolves the names of services to their endpoints.
+	Resolver Resolver
+	// Strategy determines how endpoints are chosen. Defaults to RoundRobin.
+	Strategy BalancingStrategy
+	// RefreshInterval is how long the endpoints of a service are used before they are resolved again. Defaults to 30
+	// seconds.
+	RefreshInterval time.Duration
+	// EjectionDuration is how long an endpoint is avoided for after a request to it fails with a transport error.
+	// Defaults to 30 seconds.
+	EjectionDuration time.Duration
+}
+
+// A balancerEndpoint is an endpoint of a service, and the balancer's state for it.
+type balancerEndpoint struct {
+	addr         string
+	outstanding  int64 // the number of requests in flight
+	ejectedUntil int64 // when the endpoint's ejection ends, in nanoseconds since the Unix epoch
+}
+
+// A balancerTarget is a service to which a balancer sends requests.
+type balancerTarget struct {
+	m          sync.Mutex
+	endpoints  []*balancerEndpoint
+	expires    time.Time // when the endpoints must be resolved again
+	refreshing bool      // whether the endpoints are being resolved again in the background
+	next       uint64    // the index of the next endpoint to be chosen by RoundRobin
+}
+
+// refresh returns the target's endpoints. Until they have first been resolved, requests wait for them; after that, once
+// they have expired, they are resolved again in the background while the existing endpoints continue to be used.
+func (t *balancerTarget) refresh(req Request, name string, p *BalancerPolicy) ([]*balancerEndpoint, error) {
+	t.m.Lock()
+	endpoints := t.endpoints
+	if endpoints != nil {
+		if !t.refreshing && !time.Now().Before(t.expires) {
+			t.refreshing = true
+			go func() {
+				// The refresh isn't tied to the request which triggered it, so it isn't abandoned if that is cancelled
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(req), p.RefreshInterval)
+				defer cancel()
+				t.resolve(ctx, name, p)
+			}()
+		}
+		t.m.Unlock()
+		return endpoints, nil
+	}
+	t.m.Unlock()
+	return t.resolve(req, name, p)
+}
+
+// resolve resolves the target's endpoints. If they can't be resolved, the existing endpoints continue to be used until
+// the refresh interval has passed again.
+func (t *balancerTarget) resolve(ctx context.Context, name string, p *BalancerPolicy) ([]*balancerEndpoint, error) {
+	addrs, err := p.Resolver.Resolve(ctx, name)
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.refreshing = false
+	if err != nil {
+		if t.endpoints != nil {
+			// The refresh isn't attempted again until the interval has passed, so as not to hammer a failing resolver
+			t.expires = time.Now().Add(p.RefreshInterval)
+			return t.endpoints, nil
+		}
+		return nil, err
+	}
+	// Endpoints which are still present retain their state
+	existing := make(map[string]*balancerEndpoint, len(t.endpoints))
+	for _, e := range t.endpoints {
+		existing[e.addr] = e
+	}
+	endpoints := make([]*balancerEndpoint, len(addrs))
+	for i, addr := range addrs {
+		if e, ok := existing[addr]; ok {
+			endpoints[i] = e
+		} else {
+			endpoints[i] = &balancerEndpoint{addr: addr}
+		}
+	}
+	t.endpoints, t.expires = endpoints, time.Now().Add(p.RefreshInterval)
+	return endpoints, nil
+}
+
+// choose picks an endpoint for a request, avoiding any which are ejected unless they all are.
+func (t *balancerTarget) choose(endpoints []*balancerEndpoint, strategy BalancingStrategy) *balancerEndpoint {
+	now := time.Now().UnixNano()
+	healthy := make([]*balancerEndpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if atomic.LoadInt64(&e.ejectedUntil) <= now {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = endpoints
+	}
+
+	switch strategy {
+	case LeastOutstanding:
+		// Start the search from a different endpoint each time, so ties are broken fairly
+		start := int(atomic.AddUint64(&t.next, 1) % uint64(len(healthy)))
+		best := healthy[start]
+		for i := 1; i < len(healthy); i++ {
+			e := healthy[(start+i)%len(healthy)]
+			if atomic.LoadInt64(&e.outstanding) < atomic.LoadInt64(&best.outstanding) {
+				best = e
+			}
+		}
+		return best
+	case PowerOfTwoChoices:
+		if len(healthy) == 1 {
+			return healthy[0]
+		}
+		i := rand.Intn(len(healthy))
+		j := rand.Intn(len(healthy) - 1)
+		if j >= i {
+			j++
+		}
+		a, b := healthy[i], healthy[j]
+		if atomic.LoadInt64(&b.outstanding) < atomic.LoadInt64(&a.outstanding) {
+			return b
+		}
+		return a
+	default:
+		return healthy[int((atomic.AddUint64(&t.next, 1)-1)%uint64(len(healthy)))]
+	}
+}
+
+// LoadBalancedService returns a Service which spreads requests across the endpoints of services, sending them via svc.
+// The host of each request's URL is taken to be the name of a service: it is resolved to a set of endpoints by the
+// policy's Resolver, and replaced with the address of one of them. (The request's Host header is left as it is.)
+//
+// Endpoints to which requests fail with transport errors (ie. without any response) are ejected for a while, and
+// requests aren't sent to them unless all of the service's endpoints are ejected. Requests which fail because their own
+// context is done (eg. hedges which are no longer needed) don't eject endpoints. To detect these errors, svc should be
+// a transport like BareClient, without ErrorFilter.
+func LoadBalancedService(policy BalancerPolicy, svc Service) Service {
+	p := &policy
+	if p.RefreshInterval <= 0 {
+		p.RefreshInterval = 30 * time.Second
+	}
+	if p.EjectionDuration <= 0 {
+		p.EjectionDuration = 30 * time.Second
+	}
+	var m sync.Mutex
+	targets := map[string]*balancerTarget{}
+
+	return func(req Request) Response {
+		name := req.URL.Host
+		m.Lock()
+		t, ok := targets[name]
+		if !ok {
+			t = &balancerTarget{}
+			targets[name] = t
+		}
+		m.Unlock()
+
+		endpoints, err := t.refresh(req, name, p)
+		if err == nil && len(endpoints) == 0 {
+			err = fmt.Errorf("no endpoints for %s", name)
+		}
+		if err != nil {
+			rsp := NewResponse(req)
+			rsp.Error = terrors.InternalService("no_endpoints", fmt.Sprintf("Couldn't resolve %s: %v", name, err), map[string]string{
+				"service": name})
+			return rsp
+		}
+
+		e := t.choose(endpoints, p.Strategy)
+		u := *req.URL
+		u.Host = e.addr
+		req.URL = &u
+
+		atomic.AddInt64(&e.outstanding, 1)
+		rsp := svc(req)
+		atomic.AddInt64(&e.outstanding, -1)
+		if rsp.Response == nil && rsp.Error != nil && !cancelled(req, rsp.Error) {
+			atomic.StoreInt64(&e.ejectedUntil, time.Now().Add(p.EjectionDuration).UnixNano())
+		}
+		return rsp
+	}
+}
+
+// cancelled reports whether a request failed because its context is done, rather than because of its endpoint.
+func cancelled(req Request, err error) bool {
+	return req.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
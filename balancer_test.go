@@ -0,0 +1,258 @@
+package typhon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// balancerServers starts n servers which respond with their index, returning their addresses.
+func balancerServers(t *testing.T, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		i := i
+		s, err := Listen(Service(func(req Request) Response {
+			return req.Response(i)
+		}), "localhost:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Stop(context.Background()) })
+		addrs[i] = s.Listener().Addr().String()
+	}
+	return addrs
+}
+
+func balancerSend(t *testing.T, svc Service) int {
+	rsp := NewRequest(context.Background(), "GET", "http://users/", nil).SendVia(svc).Response()
+	require.NoError(t, rsp.Error)
+	var i int
+	require.NoError(t, rsp.Decode(&i))
+	return i
+}
+
+func TestLoadBalancedService(t *testing.T) {
+	t.Parallel()
+
+	addrs := balancerServers(t, 3)
+	for _, strategy := range []BalancingStrategy{RoundRobin, LeastOutstanding, PowerOfTwoChoices} {
+		strategy := strategy
+		t.Run(fmt.Sprint(strategy), func(t *testing.T) {
+			t.Parallel()
+			svc := LoadBalancedService(BalancerPolicy{
+				Resolver: StaticResolver{"users": addrs},
+				Strategy: strategy}, BareClient).Filter(ErrorFilter)
+
+			counts := make([]int, len(addrs))
+			for i := 0; i < 30; i++ {
+				counts[balancerSend(t, svc)]++
+			}
+			for i, c := range counts {
+				if strategy == PowerOfTwoChoices {
+					assert.NotZero(t, c, "endpoint %d", i)
+				} else {
+					assert.Equal(t, 10, c, "endpoint %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBalancedServiceLeastOutstanding(t *testing.T) {
+	t.Parallel()
+
+	// Requests to a slow endpoint remain outstanding, so the fast one receives the rest
+	release := make(chan struct{})
+	var m sync.Mutex
+	counts := map[string]int{}
+	svc := LoadBalancedService(BalancerPolicy{
+		Resolver: StaticResolver{"users": {"slow", "fast"}},
+		Strategy: LeastOutstanding}, func(req Request) Response {
+		m.Lock()
+		counts[req.URL.Host]++
+		m.Unlock()
+		if req.URL.Host == "slow" {
+			<-release
+		}
+		return req.Response(nil)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svc(NewRequest(context.Background(), "GET", "http://users/", nil))
+		}()
+		time.Sleep(time.Millisecond)
+	}
+	assert.Eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return counts["slow"]+counts["fast"] == 10
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, counts["slow"])
+	assert.Equal(t, 9, counts["fast"])
+}
+
+func TestLoadBalancedServiceEjection(t *testing.T) {
+	t.Parallel()
+
+	addrs := balancerServers(t, 2)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	dead := l.Addr().String()
+	l.Close()
+
+	svc := LoadBalancedService(BalancerPolicy{
+		Resolver: StaticResolver{"users": append(addrs, dead)}}, BareClient).Filter(ErrorFilter)
+
+	// The dead endpoint fails once, and then is ejected
+	failures := 0
+	for i := 0; i < 20; i++ {
+		rsp := NewRequest(context.Background(), "GET", "http://users/", nil).SendVia(svc).Response()
+		if rsp.Error != nil {
+			failures++
+		}
+	}
+	assert.Equal(t, 1, failures)
+}
+
+func TestLoadBalancedServiceCancellationDoesntEject(t *testing.T) {
+	t.Parallel()
+
+	// Requests which fail because they are cancelled (eg. hedges which lose) don't eject their endpoint
+	var hosts []string
+	svc := LoadBalancedService(BalancerPolicy{
+		Resolver: StaticResolver{"users": {"a", "b"}}}, func(req Request) Response {
+		hosts = append(hosts, req.URL.Host)
+		if req.Err() != nil {
+			return Response{Error: terrors.Wrap(req.Err(), nil)}
+		}
+		return req.Response(nil)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rsp := svc(NewRequest(ctx, "GET", "http://users/", nil))
+	require.Error(t, rsp.Error)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, svc(NewRequest(context.Background(), "GET", "http://users/", nil)).Error)
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b", "a"}, hosts)
+}
+
+func TestLoadBalancedServiceRefresh(t *testing.T) {
+	t.Parallel()
+
+	addrs := balancerServers(t, 2)
+	r := StaticResolver{"users": addrs[:1]}
+	var m sync.Mutex
+	svc := LoadBalancedService(BalancerPolicy{
+		Resolver: resolverFunc(func(ctx context.Context, name string) ([]string, error) {
+			m.Lock()
+			defer m.Unlock()
+			return r.Resolve(ctx, name)
+		}),
+		RefreshInterval: 10 * time.Millisecond}, BareClient).Filter(ErrorFilter)
+	assert.Equal(t, 0, balancerSend(t, svc))
+
+	m.Lock()
+	r["users"] = addrs[1:]
+	m.Unlock()
+	assert.Eventually(t, func() bool {
+		return balancerSend(t, svc) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// Names which can't be resolved fail
+	rsp := NewRequest(context.Background(), "GET", "http://accounts/", nil).SendVia(svc).Response()
+	require.Error(t, rsp.Error)
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrInternalService))
+}
+
+func TestLoadBalancedServiceRefreshInBackground(t *testing.T) {
+	t.Parallel()
+
+	// Once endpoints have been resolved, requests don't wait for them to be resolved again, and refreshes aren't
+	// affected by the cancellation of the request which triggers them
+	release := make(chan struct{})
+	var resolves int32
+	svc := LoadBalancedService(BalancerPolicy{
+		Resolver: resolverFunc(func(ctx context.Context, name string) ([]string, error) {
+			if atomic.AddInt32(&resolves, 1) > 1 {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				return []string{"b"}, nil
+			}
+			return []string{"a"}, nil
+		}),
+		RefreshInterval: time.Millisecond}, func(req Request) Response {
+		return req.Response(req.URL.Host)
+	})
+	send := func(ctx context.Context) string {
+		rsp := svc(NewRequest(ctx, "GET", "http://users/", nil))
+		require.NoError(t, rsp.Error)
+		var host string
+		require.NoError(t, rsp.Decode(&host))
+		return host
+	}
+	assert.Equal(t, "a", send(context.Background()))
+	time.Sleep(2 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Equal(t, "a", send(ctx))
+	cancel()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&resolves) == 2
+	}, time.Second, time.Millisecond)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "a", send(context.Background()))
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&resolves))
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return send(context.Background()) == "b"
+	}, time.Second, time.Millisecond)
+}
+
+func TestLoadBalancedServiceRefreshFailure(t *testing.T) {
+	t.Parallel()
+
+	// While the resolver is failing, it isn't called again until the refresh interval has passed
+	var resolves int32
+	svc := LoadBalancedService(BalancerPolicy{
+		Resolver: resolverFunc(func(ctx context.Context, name string) ([]string, error) {
+			if atomic.AddInt32(&resolves, 1) > 1 {
+				return nil, fmt.Errorf("resolver unavailable")
+			}
+			return []string{"a"}, nil
+		}),
+		RefreshInterval: 20 * time.Millisecond}, func(req Request) Response {
+		return req.Response(nil)
+	})
+	start := time.Now()
+	for time.Since(start) < 100*time.Millisecond {
+		require.NoError(t, svc(NewRequest(context.Background(), "GET", "http://users/", nil)).Error)
+		time.Sleep(100 * time.Microsecond)
+	}
+	n := atomic.LoadInt32(&resolves)
+	assert.GreaterOrEqual(t, n, int32(2))
+	assert.LessOrEqual(t, n, int32(7))
+}
+
+type resolverFunc func(ctx context.Context, name string) ([]string, error)
+
+func (f resolverFunc) Resolve(ctx context.Context, name string) ([]string, error) {
+	return f(ctx, name)
+}
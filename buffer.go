@@ -2,6 +2,7 @@ package typhon
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"sync"
 )
@@ -25,18 +26,19 @@ type streamer struct {
 }
 
 // Streamer returns a reader/writer/closer that can be used to stream responses. A simple use of this is:
-//  func streamingService(req typhon.Request) typhon.Response {
-//      body := typhon.Streamer()
-//      go func() {
-//          // do something to asynchronously produce output into body
-//          if err != nil {
-//              body.CloseWithError(err)
-//              return
-//          }
-//          body.Close()
-//      }()
-//      return req.Response(body)
-//  }
+//
+//	func streamingService(req typhon.Request) typhon.Response {
+//	    body := typhon.Streamer()
+//	    go func() {
+//	        // do something to asynchronously produce output into body
+//	        if err != nil {
+//	            body.CloseWithError(err)
+//	            return
+//	        }
+//	        body.Close()
+//	    }()
+//	    return req.Response(body)
+//	}
 //
 // Note that a Streamer may not perform any internal buffering, so callers should take care not to depend on writes
 // being non-blocking. If buffering is needed, Streamer can be wrapped in a bufio.Writer.
@@ -69,8 +71,9 @@ func (s *streamer) CloseWithError(err error) error {
 type doneReader struct {
 	closed     chan struct{}
 	closedOnce sync.Once
-	length     int64 // length of the underlying reader in bytes, if known. ≤0 indicates unknown
-	read       int64 // number of bytes read
+	stop       func() bool // if set, called when the reader is closed (eg. to unregister a context.AfterFunc)
+	length     int64       // length of the underlying reader in bytes, if known. ≤0 indicates unknown
+	read       int64       // number of bytes read
 	io.ReadCloser
 }
 
@@ -82,6 +85,15 @@ func newDoneReader(r io.ReadCloser, length int64) *doneReader {
 }
 
 func (r *doneReader) Close() error {
+	err := r.close()
+	if r.stop != nil {
+		r.stop()
+	}
+	return err
+}
+
+// close closes the reader without calling stop, for use from outside the goroutine which owns it.
+func (r *doneReader) close() error {
 	err := r.ReadCloser.Close()
 	r.closedOnce.Do(func() { close(r.closed) })
 	return err
@@ -102,3 +114,32 @@ func (r *doneReader) Read(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+// cancelOnClose is a response body which cancels the context of its request when it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// cancelWithBody arranges for cancel to be called once the response's body is finished with. The context of a request
+// must outlive the Service which produced its response if the body is still streaming: so that it isn't leaked, it is
+// cancelled when the body is closed. Responses without a body, or with a buffered one, are cancelled immediately.
+func cancelWithBody(rsp Response, cancel context.CancelFunc) Response {
+	if rsp.Response == nil || rsp.Body == nil {
+		cancel()
+		return rsp
+	}
+	if _, buffered := rsp.Body.(*bufCloser); buffered {
+		cancel()
+		return rsp
+	}
+	rsp.Body = cancelOnClose{
+		ReadCloser: rsp.Body,
+		cancel:     cancel}
+	return rsp
+}
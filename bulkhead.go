@@ -0,0 +1,112 @@
+package typhon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/monzo/terrors"
+)
+
+// ErrBulkheadFull is the terror code used by BulkheadFilter when it rejects a request because too many are already in
+// flight. As a rate_limited code, ErrorFilter maps it to 429 (Too Many Requests).
+const ErrBulkheadFull = terrors.ErrRateLimited + ".bulkhead_full"
+
+// A BulkheadPolicy configures BulkheadFilter.
+type BulkheadPolicy struct {
+	// Key returns the key of the bulkhead through which a request passes. Defaults to the host of the request's URL.
+	Key func(Request) string
+	// MaxConcurrency is the maximum number of requests with the same key which may be in flight at once. Defaults to
+	// 100.
+	MaxConcurrency int
+	// MaxQueue is the maximum number of requests with the same key which may wait for others to finish, once
+	// MaxConcurrency is reached. Waiting requests give up when their context is done. Defaults to 0: requests are
+	// rejected immediately.
+	MaxQueue int
+}
+
+// A bulkhead limits the concurrency of the requests with a single key.
+type bulkhead struct {
+	slots  chan struct{} // holds a value for each request in flight
+	m      sync.Mutex
+	queued int // requests waiting for a slot
+}
+
+// acquire waits for a slot, returning false if none is available and the queue is full, or if ctx is done first.
+func (b *bulkhead) acquire(ctx context.Context, maxQueue int) bool {
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	b.m.Lock()
+	if b.queued >= maxQueue {
+		b.m.Unlock()
+		return false
+	}
+	b.queued++
+	b.m.Unlock()
+	defer func() {
+		b.m.Lock()
+		b.queued--
+		b.m.Unlock()
+	}()
+
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (b *bulkhead) release() {
+	<-b.slots
+}
+
+// BulkheadFilter returns a Filter which limits the number of requests in flight to each downstream (by default, each
+// target host), so that a slow dependency can't tie up an unbounded number of goroutines. Requests over the limit
+// wait in a bounded queue if one is configured, or are rejected with an ErrBulkheadFull error.
+//
+// A request is in flight until the Service it is sent to returns, which may be before its response body has been read.
+func BulkheadFilter(policy BulkheadPolicy) Filter {
+	p := &policy
+	if p.Key == nil {
+		p.Key = requestTargetHost
+	}
+	if p.MaxConcurrency <= 0 {
+		p.MaxConcurrency = 100
+	}
+	if p.MaxQueue < 0 {
+		p.MaxQueue = 0
+	}
+
+	var m sync.Mutex
+	bulkheads := map[string]*bulkhead{}
+
+	return func(req Request, svc Service) Response {
+		key := p.Key(req)
+		m.Lock()
+		b, ok := bulkheads[key]
+		if !ok {
+			b = &bulkhead{
+				slots: make(chan struct{}, p.MaxConcurrency)}
+			bulkheads[key] = b
+		}
+		m.Unlock()
+
+		ctx := req.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if !b.acquire(ctx, p.MaxQueue) {
+			rsp := NewResponse(req)
+			rsp.Error = terrors.New(ErrBulkheadFull, fmt.Sprintf("Too many requests in flight to %s", key), map[string]string{
+				"bulkhead": key})
+			return rsp
+		}
+		defer b.release()
+		return svc(req)
+	}
+}
@@ -0,0 +1,106 @@
+package typhon
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingService returns a Service whose requests block until release is closed, and a counter of those in flight.
+func blockingService(release <-chan struct{}) (Service, *int32) {
+	var inflight int32
+	return func(req Request) Response {
+		atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		<-release
+		return req.Response(nil)
+	}, &inflight
+}
+
+func TestBulkheadFilter(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	inner, inflight := blockingService(release)
+	svc := inner.Filter(BulkheadFilter(BulkheadPolicy{
+		MaxConcurrency: 2}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp := svc(NewRequest(context.Background(), "GET", "http://users/", nil))
+			assert.NoError(t, rsp.Error)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(inflight) == 2
+	}, time.Second, time.Millisecond)
+
+	// Further requests to the same host are rejected, but other hosts are unaffected
+	rsp := svc(NewRequest(context.Background(), "GET", "http://users/", nil))
+	require.Error(t, rsp.Error)
+	assert.True(t, terrors.Is(rsp.Error, ErrBulkheadFull))
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrRateLimited))
+	assert.Equal(t, http.StatusTooManyRequests, ErrorStatusCode(rsp.Error))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rsp := svc(NewRequest(context.Background(), "GET", "http://accounts/", nil))
+		assert.NoError(t, rsp.Error)
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(inflight) == 3
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+	rsp = svc(NewRequest(context.Background(), "GET", "http://users/", nil))
+	assert.NoError(t, rsp.Error)
+}
+
+func TestBulkheadFilterQueue(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	inner, inflight := blockingService(release)
+	svc := inner.Filter(BulkheadFilter(BulkheadPolicy{
+		Key:            func(Request) string { return "all" },
+		MaxConcurrency: 1,
+		MaxQueue:       1}))
+
+	results := make(chan Response, 2)
+	go func() { results <- svc(NewRequest(context.Background(), "GET", "/", nil)) }()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(inflight) == 1
+	}, time.Second, time.Millisecond)
+
+	// The next request waits in the queue until its deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	rsp := svc(NewRequest(ctx, "GET", "/", nil))
+	require.Error(t, rsp.Error)
+	assert.True(t, terrors.Is(rsp.Error, ErrBulkheadFull))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// A queued request proceeds once a slot is released; meanwhile the queue is full, so others are rejected
+	go func() { results <- svc(NewRequest(context.Background(), "GET", "/", nil)) }()
+	time.Sleep(10 * time.Millisecond)
+	rsp = svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.True(t, terrors.Is(rsp.Error, ErrBulkheadFull))
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, (<-results).Error)
+	}
+}
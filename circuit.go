@@ -0,0 +1,263 @@
+package typhon
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/monzo/terrors"
+)
+
+// ErrCircuitOpen is the terror code used by CircuitBreakerFilter when it rejects a request because its circuit is open.
+// ErrorFilter maps it to 503 (Service Unavailable).
+const ErrCircuitOpen = "circuit_open"
+
+// A CircuitState is the state of a circuit within CircuitBreakerFilter.
+type CircuitState int
+
+const (
+	// CircuitClosed circuits allow all requests through, while monitoring their failure rate.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen circuits reject all requests.
+	CircuitOpen
+	// CircuitHalfOpen circuits allow a limited number of probe requests through, to determine whether the circuit should
+	// close again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// A CircuitBreakerPolicy configures CircuitBreakerFilter.
+type CircuitBreakerPolicy struct {
+	// Key returns the key of the circuit through which a request passes. Defaults to the host of the request's URL.
+	Key func(Request) string
+	// Window is the period over which the failure rate of a circuit is measured. Defaults to 10 seconds.
+	Window time.Duration
+	// MinRequests is the number of requests which must be made through a circuit within the window before it can open.
+	// Defaults to 20.
+	MinRequests int
+	// FailureRate is the proportion of requests within the window (between 0 and 1) which must fail for the circuit to
+	// open. Defaults to 0.5.
+	FailureRate float64
+	// OpenDuration is how long a circuit stays open before it becomes half-open. Defaults to 5 seconds.
+	OpenDuration time.Duration
+	// Probes is the number of requests which a half-open circuit allows through. If they all succeed the circuit closes;
+	// if any fails, it opens again. Defaults to 1.
+	Probes int
+	// Failure reports whether a response counts as a failure. By default, failures are those where no response was
+	// received, or with a 5xx status, or with an internal_service, timeout or unknown error. Requests which fail because
+	// their own context is done (eg. hedges which are no longer needed) aren't counted either way.
+	Failure func(Response) bool
+	// OnStateChange, if set, is called whenever a circuit changes state. It must not block, and may be called
+	// concurrently.
+	OnStateChange func(key string, from, to CircuitState)
+}
+
+// circuitFailure is the default CircuitBreakerPolicy.Failure.
+func circuitFailure(rsp Response) bool {
+	switch {
+	case rsp.Response == nil:
+		return rsp.Error != nil
+	case rsp.StatusCode >= 500:
+		return true
+	default:
+		return terrors.Is(rsp.Error, terrors.ErrInternalService, terrors.ErrTimeout, terrors.ErrUnknown)
+	}
+}
+
+const circuitBuckets = 10 // the number of buckets into which a circuit's window is divided
+
+type circuitBucket struct {
+	epoch              int64 // the index of the period since the Unix epoch which the bucket counts
+	requests, failures int
+}
+
+// A circuitChange describes a change in the state of a circuit.
+type circuitChange struct {
+	from, to CircuitState
+}
+
+// A circuit tracks the state of the requests with a single key.
+type circuit struct {
+	m         sync.Mutex
+	state     CircuitState
+	openedAt  time.Time
+	probes    int // probes in flight while half-open
+	successes int // successful probes while half-open
+	buckets   [circuitBuckets]circuitBucket
+}
+
+// allow reports whether a request may pass through the circuit, and if so, whether it is a probe. It also returns any
+// change in the circuit's state.
+func (c *circuit) allow(p *CircuitBreakerPolicy, now time.Time) (ok, probe bool, changed *circuitChange) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.state == CircuitOpen && now.Sub(c.openedAt) >= p.OpenDuration {
+		changed = c.transition(CircuitHalfOpen, now)
+	}
+	switch {
+	case c.state == CircuitClosed:
+		return true, false, changed
+	case c.state == CircuitHalfOpen && c.probes < p.Probes-c.successes:
+		c.probes++
+		return true, true, changed
+	default:
+		return false, false, changed
+	}
+}
+
+// record accounts for the outcome of a request which passed through the circuit, returning any change in its state.
+func (c *circuit) record(p *CircuitBreakerPolicy, now time.Time, probe, failed bool) *circuitChange {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if probe {
+		c.probes--
+		if c.state != CircuitHalfOpen {
+			return nil
+		}
+		if failed {
+			return c.transition(CircuitOpen, now)
+		}
+		if c.successes++; c.successes >= p.Probes {
+			return c.transition(CircuitClosed, now)
+		}
+		return nil
+	}
+	if c.state != CircuitClosed {
+		return nil // the request was allowed before the circuit opened
+	}
+
+	width := max(int64(p.Window/circuitBuckets), 1)
+	epoch := now.UnixNano() / width
+	b := &c.buckets[epoch%circuitBuckets]
+	if b.epoch != epoch {
+		*b = circuitBucket{epoch: epoch}
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+
+	requests, failures := 0, 0
+	for _, b := range c.buckets {
+		if b.epoch > epoch-circuitBuckets {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	if requests >= p.MinRequests && float64(failures) >= p.FailureRate*float64(requests) {
+		return c.transition(CircuitOpen, now)
+	}
+	return nil
+}
+
+// abandon accounts for a request which passed through the circuit but whose outcome doesn't reflect the health of the
+// upstream, as it was cancelled.
+func (c *circuit) abandon(probe bool) {
+	if probe {
+		c.m.Lock()
+		defer c.m.Unlock()
+		c.probes--
+	}
+}
+
+func (c *circuit) transition(to CircuitState, now time.Time) *circuitChange {
+	change := &circuitChange{
+		from: c.state,
+		to:   to}
+	c.state = to
+	c.probes, c.successes = 0, 0
+	switch to {
+	case CircuitOpen:
+		c.openedAt = now
+	case CircuitClosed:
+		c.buckets = [circuitBuckets]circuitBucket{}
+	}
+	return change
+}
+
+// requestTargetHost returns the host to which a request is sent: that of its URL, or otherwise its Host header. It is the
+// default key by which requests are grouped by CircuitBreakerFilter and BulkheadFilter.
+func requestTargetHost(req Request) string {
+	if req.URL != nil && req.URL.Host != "" {
+		return req.URL.Host
+	}
+	return req.Host
+}
+
+// CircuitBreakerFilter returns a Filter which stops sending requests to unhealthy upstreams, so they fail fast rather
+// than waiting for timeouts. Requests are grouped into circuits by key (by default, their target host). When the
+// proportion of a circuit's requests which fail exceeds a threshold, the circuit opens and further requests fail
+// immediately with an ErrCircuitOpen error. After a while the circuit becomes half-open, and allows a few probe
+// requests through to decide whether to close again.
+func CircuitBreakerFilter(policy CircuitBreakerPolicy) Filter {
+	p := &policy
+	if p.Key == nil {
+		p.Key = requestTargetHost
+	}
+	if p.Window <= 0 {
+		p.Window = 10 * time.Second
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = 20
+	}
+	if p.FailureRate <= 0 || p.FailureRate > 1 {
+		p.FailureRate = 0.5
+	}
+	if p.OpenDuration <= 0 {
+		p.OpenDuration = 5 * time.Second
+	}
+	if p.Probes <= 0 {
+		p.Probes = 1
+	}
+	if p.Failure == nil {
+		p.Failure = circuitFailure
+	}
+
+	var m sync.Mutex
+	circuits := map[string]*circuit{}
+	notify := func(key string, change *circuitChange) {
+		if change != nil && p.OnStateChange != nil {
+			p.OnStateChange(key, change.from, change.to)
+		}
+	}
+
+	return func(req Request, svc Service) Response {
+		key := p.Key(req)
+		m.Lock()
+		c, ok := circuits[key]
+		if !ok {
+			c = &circuit{}
+			circuits[key] = c
+		}
+		m.Unlock()
+
+		allowed, probe, changed := c.allow(p, time.Now())
+		notify(key, changed)
+		if !allowed {
+			rsp := NewResponse(req)
+			rsp.Error = terrors.New(ErrCircuitOpen, fmt.Sprintf("Circuit %s is open", key), map[string]string{
+				"circuit": key})
+			return rsp
+		}
+
+		rsp := svc(req)
+		if rsp.Error != nil && cancelled(req, rsp.Error) {
+			c.abandon(probe)
+			return rsp
+		}
+		notify(key, c.record(p, time.Now(), probe, p.Failure(rsp)))
+		return rsp
+	}
+}
@@ -0,0 +1,164 @@
+package typhon
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerFilter(t *testing.T) {
+	t.Parallel()
+
+	var failing int32 = 1
+	var calls int32
+	var m sync.Mutex
+	var changes []string
+	svc := Service(func(req Request) Response {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return NewResponseWithCode(req, http.StatusInternalServerError)
+		}
+		return req.Response(nil)
+	}).Filter(CircuitBreakerFilter(CircuitBreakerPolicy{
+		MinRequests:  4,
+		OpenDuration: 20 * time.Millisecond,
+		Probes:       2,
+		OnStateChange: func(key string, from, to CircuitState) {
+			m.Lock()
+			defer m.Unlock()
+			changes = append(changes, key+" "+from.String()+" → "+to.String())
+		}}))
+	send := func(host string) Response {
+		return svc(NewRequest(context.Background(), "GET", "http://"+host+"/", nil))
+	}
+
+	// The circuit opens once enough requests have failed
+	for i := 0; i < 4; i++ {
+		rsp := send("a")
+		assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+	}
+	rsp := send("a")
+	require.Error(t, rsp.Error)
+	assert.True(t, terrors.Is(rsp.Error, ErrCircuitOpen))
+	assert.Equal(t, http.StatusServiceUnavailable, ErrorStatusCode(rsp.Error))
+	assert.EqualValues(t, 4, atomic.LoadInt32(&calls))
+
+	// Circuits are independent for each host
+	rsp = send("b")
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+	assert.EqualValues(t, 5, atomic.LoadInt32(&calls))
+
+	// Once half-open, a failed probe opens the circuit again
+	time.Sleep(25 * time.Millisecond)
+	rsp = send("a")
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+	rsp = send("a")
+	assert.True(t, terrors.Is(rsp.Error, ErrCircuitOpen))
+
+	// Successful probes close it
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(25 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		rsp = send("a")
+		require.NoError(t, rsp.Error)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, []string{
+		"a closed → open",
+		"a open → half-open",
+		"a half-open → open",
+		"a open → half-open",
+		"a half-open → closed"}, changes)
+}
+
+func TestCircuitBreakerFilterFailures(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	svc := Service(func(req Request) Response {
+		atomic.AddInt32(&calls, 1)
+		rsp := NewResponse(req)
+		rsp.Error = terrors.NotFound("missing", "Not here", nil)
+		return rsp
+	}).Filter(CircuitBreakerFilter(CircuitBreakerPolicy{
+		MinRequests: 1,
+		Key: func(req Request) string {
+			return "key"
+		}}))
+
+	// Errors which are the caller's fault don't open the circuit
+	for i := 0; i < 10; i++ {
+		rsp := svc(NewRequest(context.Background(), "GET", "/", nil))
+		assert.True(t, terrors.Is(rsp.Error, terrors.ErrNotFound))
+	}
+	assert.EqualValues(t, 10, atomic.LoadInt32(&calls))
+}
+
+func TestCircuitBreakerFilterCancellation(t *testing.T) {
+	t.Parallel()
+
+	// Requests which time out or are cancelled by the caller don't open the circuit, even if no response is received
+	svc := Service(func(req Request) Response {
+		select {
+		case <-req.Done():
+			return Response{
+				Request: &req,
+				Error:   terrors.Wrap(req.Err(), nil)}
+		case <-time.After(50 * time.Millisecond):
+			return req.Response(nil)
+		}
+	}).Filter(CircuitBreakerFilter(CircuitBreakerPolicy{
+		MinRequests: 5,
+		Key: func(req Request) string {
+			return "key"
+		}}))
+
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		rsp := svc(NewRequest(ctx, "GET", "/", nil))
+		cancel()
+		require.Error(t, rsp.Error)
+		assert.False(t, terrors.Is(rsp.Error, ErrCircuitOpen))
+	}
+	rsp := svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.NoError(t, rsp.Error)
+}
+
+func TestCircuitBreakerFilterConcurrentProbes(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	var failing int32 = 1
+	svc := Service(func(req Request) Response {
+		if atomic.LoadInt32(&failing) == 1 {
+			return Response{Error: terrors.Timeout("", "", nil)}
+		}
+		<-release
+		return req.Response(nil)
+	}).Filter(CircuitBreakerFilter(CircuitBreakerPolicy{
+		MinRequests:  1,
+		OpenDuration: time.Millisecond}))
+
+	svc(NewRequest(context.Background(), "GET", "/", nil))
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(5 * time.Millisecond)
+
+	// Only one probe is allowed through at a time
+	probe := SendVia(NewRequest(context.Background(), "GET", "/", nil), svc)
+	time.Sleep(5 * time.Millisecond)
+	rsp := svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.True(t, terrors.Is(rsp.Error, ErrCircuitOpen))
+	close(release)
+	require.NoError(t, probe.Response().Error)
+	rsp = svc(NewRequest(context.Background(), "GET", "/", nil))
+	require.NoError(t, rsp.Error)
+}
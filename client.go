@@ -49,8 +49,9 @@ func newH2cRoundTripper() *http.Transport {
 
 // A ResponseFuture is a container for a Response which will materialise at some point.
 type ResponseFuture struct {
-	done <-chan struct{} // guards access to r
-	r    Response
+	done   <-chan struct{} // guards access to r
+	r      Response
+	cancel context.CancelFunc
 }
 
 // WaitC returns a channel which can be waited upon until the response is available
@@ -64,6 +65,129 @@ func (f *ResponseFuture) Response() Response {
 	return f.r
 }
 
+// Cancel cancels the context of the request(s) producing the response, if it isn't yet available. The response is still
+// materialised as usual, but will typically contain a cancellation error. Once the response is available, Cancel does
+// nothing, so that its body can still be read: to abandon it, close the body instead.
+func (f *ResponseFuture) Cancel() {
+	select {
+	case <-f.done:
+		return
+	default:
+	}
+	if f.cancel != nil {
+		f.cancel()
+	}
+}
+
+// WaitContext blocks until the response is available or ctx is done, whichever is first. In the latter case, the
+// request is cancelled, a timeout error is returned, and the response's body is closed once it arrives.
+func (f *ResponseFuture) WaitContext(ctx context.Context) Response {
+	select {
+	case <-f.WaitC():
+		return f.r
+	case <-ctx.Done():
+		f.Cancel()
+		go discardResponse(f)
+		return Response{
+			Error: terrors.Timeout("wait_cancelled", "Stopped waiting for response: "+ctx.Err().Error(), nil)}
+	}
+}
+
+// Then returns a ResponseFuture for the result of calling fn with the response, once it is available. fn takes
+// ownership of the response, so it must close its body if it doesn't return it. Cancelling the returned future cancels
+// this one.
+func (f *ResponseFuture) Then(fn func(Response) Response) *ResponseFuture {
+	g, done := newResponseFuture(f.Cancel)
+	go func() {
+		defer close(done)
+		g.r = fn(f.Response())
+	}()
+	return g
+}
+
+// All blocks until all of the responses are available, returning them in the same order as the futures.
+func All(futures ...*ResponseFuture) []Response {
+	rsps := make([]Response, len(futures))
+	for i, f := range futures {
+		rsps[i] = f.Response()
+	}
+	return rsps
+}
+
+// Any returns a ResponseFuture for the first of the responses to become available, whether or not it is successful.
+// The others are cancelled, and their bodies closed.
+func Any(futures ...*ResponseFuture) *ResponseFuture {
+	return firstOf(futures, func(Response) bool { return true })
+}
+
+// FirstSuccess returns a ResponseFuture for the first of the responses to become available without an error. The
+// others are cancelled, and their bodies closed. If none are successful, it resolves to the last of them.
+func FirstSuccess(futures ...*ResponseFuture) *ResponseFuture {
+	return firstOf(futures, func(rsp Response) bool { return rsp.Error == nil })
+}
+
+// firstOf returns a ResponseFuture for the first response which is accepted by ok, or if none are, for the last one.
+func firstOf(futures []*ResponseFuture, ok func(Response) bool) *ResponseFuture {
+	cancelAll := func() {
+		for _, f := range futures {
+			f.Cancel()
+		}
+	}
+	g, done := newResponseFuture(cancelAll)
+	if len(futures) == 0 {
+		g.r = Response{
+			Error: terrors.BadRequest("no_futures", "No responses to wait for", nil)}
+		close(done)
+		return g
+	}
+
+	results := make(chan *ResponseFuture, len(futures))
+	for _, f := range futures {
+		go func(f *ResponseFuture) {
+			<-f.WaitC()
+			results <- f
+		}(f)
+	}
+	go func() {
+		defer close(done)
+		for pending := len(futures); pending > 0; pending-- {
+			f := <-results
+			if !ok(f.r) && pending > 1 {
+				discardResponse(f)
+				continue
+			}
+			// This is the winner: the others are cancelled, and their responses discarded when they arrive
+			g.r = f.r
+			for _, other := range futures {
+				if other != f {
+					other.Cancel()
+				}
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					discardResponse(<-results)
+				}
+			}(pending - 1)
+			return
+		}
+	}()
+	return g
+}
+
+func newResponseFuture(cancel context.CancelFunc) (*ResponseFuture, chan struct{}) {
+	done := make(chan struct{})
+	return &ResponseFuture{
+		done:   done,
+		cancel: cancel}, done
+}
+
+// discardResponse waits for a response which isn't wanted, and closes its body.
+func discardResponse(f *ResponseFuture) {
+	if rsp := f.Response(); rsp.Response != nil && rsp.Body != nil {
+		rsp.Body.Close()
+	}
+}
+
 // HttpService returns a Service which sends requests via the given net/http RoundTripper.
 // Only use this if you need to do something custom at the transport level.
 func HttpService(rt http.RoundTripper) Service {
@@ -85,17 +209,12 @@ func HttpService(rt http.RoundTripper) Service {
 		// This protects callers that forget to call Close(), or those which proxy responses upstream
 		//
 		// If the calling context is infinite (ie. returns nil for Done()), it can never signal cancellation
-		// so we bypass this as a performance optimisation
-		if httpRsp != nil && httpRsp.Body != nil && ctx.Done() != nil {
+		// so we bypass this as a performance optimisation. Rather than a goroutine per response, the close is
+		// registered with context.AfterFunc, and unregistered when the body is closed.
+		if httpRsp != nil && httpRsp.Body != nil && httpRsp.Body != http.NoBody && ctx.Done() != nil {
 			body := newDoneReader(httpRsp.Body, httpRsp.ContentLength)
 			httpRsp.Body = body
-			go func() {
-				select {
-				case <-body.closed:
-				case <-ctx.Done():
-					body.Close()
-				}
-			}()
+			body.stop = context.AfterFunc(ctx, func() { body.close() })
 		}
 		return Response{
 			Request:  &req,
@@ -112,16 +231,38 @@ func BareClient(req Request) Response {
 // SendVia round-trips the request via the passed Service. It does not block, instead returning a ResponseFuture
 // representing the asynchronous operation to produce the response.
 func SendVia(req Request, svc Service) *ResponseFuture {
-	done := make(chan struct{}, 0)
-	f := &ResponseFuture{
-		done: done}
+	parent := req.unwrappedContext()
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	sent := req
+	sent.Context = ctx
+	f, done := newResponseFuture(cancel)
 	go func() {
 		defer close(done) // makes the response available to waiters
-		f.r = svc(req)
+		f.r = svc(sent)
+		// The response refers to the request as it was passed in, rather than with the cancellable context
+		if f.r.Request != nil && f.r.Request.Context == ctx {
+			r := *f.r.Request
+			r.Context = req.Context
+			f.r.Request = &r
+		}
+		// Once the response is available, cancellation only matters if its body is still streaming (HttpService closes
+		// it when the context is cancelled): otherwise the context is released when the body is closed
+		f.r = cancelWithBody(f.r, cancel)
 	}()
 	return f
 }
 
+// Do round-trips the request via the passed Service, blocking until the response is available. Unlike SendVia, it
+// calls the Service directly, without a goroutine or a cancellable context of its own (so the response can't be
+// cancelled other than via the request's context, and its Request isn't rewritten), which makes it preferable when the
+// response is waited for immediately.
+func Do(req Request, svc Service) Response {
+	return svc(req)
+}
+
 // Send round-trips the request via the default Client. It does not block, instead returning a ResponseFuture
 // representing the asynchronous operation to produce the response. It is equivalent to:
 //
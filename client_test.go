@@ -5,8 +5,12 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/monzo/terrors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -64,3 +68,243 @@ func TestHttpServiceStreamingBodyHasNoGetBody(t *testing.T) {
 
 	assert.Nil(t, captured.GetBody, "GetBody must stay nil for a streaming body")
 }
+
+// trackedBody is a streaming body which records whether it has been closed.
+type trackedBody struct {
+	io.Reader
+	closed int32
+}
+
+func (b *trackedBody) Close() error {
+	atomic.StoreInt32(&b.closed, 1)
+	return nil
+}
+
+func (b *trackedBody) isClosed() bool {
+	return atomic.LoadInt32(&b.closed) == 1
+}
+
+// futureService returns a Service which responds with a tracked body after delay, or with an error if the request is
+// cancelled first.
+func futureService(delay time.Duration, body *trackedBody) Service {
+	return func(req Request) Response {
+		select {
+		case <-req.Done():
+			rsp := NewResponse(req)
+			rsp.Error = req.Err()
+			return rsp
+		case <-time.After(delay):
+		}
+		rsp := NewResponse(req)
+		rsp.Body = body
+		return rsp
+	}
+}
+
+func TestResponseFutureCancel(t *testing.T) {
+	t.Parallel()
+
+	req := NewRequest(context.Background(), "GET", "/", nil)
+	f := req.SendVia(futureService(time.Hour, &trackedBody{}))
+	f.Cancel()
+	rsp := f.Response()
+	require.Error(t, rsp.Error)
+	assert.ErrorIs(t, rsp.Error, context.Canceled)
+	assert.Equal(t, req, *rsp.Request)
+
+	// Once the response is available, cancelling the future (or one derived from it) doesn't truncate its body
+	var body *trackedBody
+	svc := HttpService(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		body = &trackedBody{Reader: strings.NewReader("streamed")}
+		return &http.Response{StatusCode: http.StatusOK, Body: body, ContentLength: -1}, nil
+	}))
+	for _, wrap := range []func(*ResponseFuture) *ResponseFuture{
+		func(f *ResponseFuture) *ResponseFuture { return f },
+		func(f *ResponseFuture) *ResponseFuture { return Any(f) }} {
+		f := wrap(NewRequest(context.Background(), "GET", "/", nil).SendVia(svc))
+		rsp := f.Response()
+		require.NoError(t, rsp.Error)
+		f.Cancel()
+		time.Sleep(10 * time.Millisecond) // HttpService would close the body asynchronously
+		assert.False(t, body.isClosed())
+		b, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "streamed", string(b))
+		require.NoError(t, rsp.Body.Close())
+	}
+}
+
+func TestSendViaReleasesContext(t *testing.T) {
+	t.Parallel()
+
+	// The context of a request with a streaming response is released once the body is closed
+	var ctx context.Context
+	body := &trackedBody{Reader: strings.NewReader("streamed")}
+	rsp := NewRequest(context.Background(), "GET", "/", nil).SendVia(Service(func(req Request) Response {
+		ctx = req.Context
+		rsp := NewResponse(req)
+		rsp.Body = body
+		return rsp
+	})).Response()
+	require.NoError(t, rsp.Error)
+	assert.NoError(t, ctx.Err())
+	b, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "streamed", string(b))
+	require.NoError(t, rsp.Body.Close())
+	assert.True(t, body.isClosed())
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	// …and immediately if the response is buffered
+	rsp = NewRequest(context.Background(), "GET", "/", nil).SendVia(Service(func(req Request) Response {
+		ctx = req.Context
+		return req.Response("buffered")
+	})).Response()
+	require.NoError(t, rsp.Error)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestResponseFutureWaitContext(t *testing.T) {
+	t.Parallel()
+
+	body := &trackedBody{Reader: strings.NewReader("slow")}
+	f := NewRequest(context.Background(), "GET", "/", nil).SendVia(Service(func(req Request) Response {
+		time.Sleep(50 * time.Millisecond) // ignores cancellation
+		rsp := NewResponse(req)
+		rsp.Body = body
+		return rsp
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	rsp := f.WaitContext(ctx)
+	require.Error(t, rsp.Error)
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrTimeout))
+	assert.Eventually(t, body.isClosed, time.Second, time.Millisecond)
+
+	rsp = NewRequest(context.Background(), "GET", "/", nil).SendVia(futureService(0, &trackedBody{})).
+		WaitContext(context.Background())
+	assert.NoError(t, rsp.Error)
+}
+
+func TestResponseFutureThen(t *testing.T) {
+	t.Parallel()
+
+	f := NewRequest(context.Background(), "GET", "/", nil).SendVia(Service(func(req Request) Response {
+		return req.Response("a")
+	})).Then(func(rsp Response) Response {
+		var body string
+		if err := rsp.Decode(&body); err != nil {
+			rsp.Error = err
+			return rsp
+		}
+		return rsp.Request.Response(body + "b")
+	})
+	rsp := f.Response()
+	var body string
+	require.NoError(t, rsp.Decode(&body))
+	assert.Equal(t, "ab", body)
+
+	// Cancelling the chained future cancels the original request
+	f = NewRequest(context.Background(), "GET", "/", nil).SendVia(futureService(time.Hour, &trackedBody{})).
+		Then(func(rsp Response) Response { return rsp })
+	f.Cancel()
+	assert.ErrorIs(t, f.Response().Error, context.Canceled)
+}
+
+func TestAll(t *testing.T) {
+	t.Parallel()
+
+	futures := make([]*ResponseFuture, 3)
+	for i := range futures {
+		i := i
+		futures[i] = NewRequest(context.Background(), "GET", "/", nil).SendVia(Service(func(req Request) Response {
+			time.Sleep(time.Duration(3-i) * time.Millisecond)
+			return req.Response(i)
+		}))
+	}
+	rsps := All(futures...)
+	require.Len(t, rsps, 3)
+	for i, rsp := range rsps {
+		var body int
+		require.NoError(t, rsp.Decode(&body))
+		assert.Equal(t, i, body)
+	}
+	assert.Empty(t, All())
+}
+
+func TestAny(t *testing.T) {
+	t.Parallel()
+
+	fast, slow := &trackedBody{Reader: strings.NewReader("fast")}, &trackedBody{}
+	slowSvc := Service(func(req Request) Response {
+		<-req.Done() // responds only once cancelled, with a body which must be discarded
+		rsp := NewResponse(req)
+		rsp.Body = slow
+		return rsp
+	})
+	f := Any(
+		NewRequest(context.Background(), "GET", "/", nil).SendVia(slowSvc),
+		NewRequest(context.Background(), "GET", "/", nil).SendVia(futureService(0, fast)))
+	rsp := f.Response()
+	require.NoError(t, rsp.Error)
+	assert.Equal(t, fast, rsp.Body.(cancelOnClose).ReadCloser)
+	assert.Eventually(t, slow.isClosed, time.Second, time.Millisecond)
+	assert.False(t, fast.isClosed())
+
+	rsp = Any().Response()
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrBadRequest))
+}
+
+func TestFirstSuccess(t *testing.T) {
+	t.Parallel()
+
+	failed, succeeded := &trackedBody{}, &trackedBody{}
+	failingSvc := Service(func(req Request) Response {
+		rsp := NewResponse(req)
+		rsp.Body = failed
+		rsp.Error = terrors.InternalService("", "", nil)
+		return rsp
+	})
+	rsp := FirstSuccess(
+		NewRequest(context.Background(), "GET", "/", nil).SendVia(failingSvc),
+		NewRequest(context.Background(), "GET", "/", nil).SendVia(futureService(10*time.Millisecond, succeeded))).
+		Response()
+	require.NoError(t, rsp.Error)
+	assert.Equal(t, succeeded, rsp.Body.(cancelOnClose).ReadCloser)
+	assert.True(t, failed.isClosed())
+
+	// If all of them fail, the last failure is returned
+	rsp = FirstSuccess(
+		NewRequest(context.Background(), "GET", "/", nil).SendVia(failingSvc),
+		NewRequest(context.Background(), "GET", "/", nil).SendVia(failingSvc)).
+		Response()
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrInternalService))
+}
+
+// TestHttpServiceClosesBodyOnCancellation verifies that response bodies are closed when the request's context is
+// cancelled, and that they are unaffected by cancellation after they have been closed.
+func TestHttpServiceClosesBodyOnCancellation(t *testing.T) {
+	t.Parallel()
+
+	var body *trackedBody
+	svc := HttpService(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		body = &trackedBody{Reader: strings.NewReader("streamed")}
+		return &http.Response{StatusCode: http.StatusOK, Body: body, ContentLength: -1}, nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rsp := NewRequest(ctx, "GET", "/", nil).Do(svc)
+	require.NoError(t, rsp.Error)
+	assert.False(t, body.isClosed())
+	cancel()
+	assert.Eventually(t, body.isClosed, time.Second, time.Millisecond)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	rsp = Do(NewRequest(ctx, "GET", "/", nil), svc)
+	require.NoError(t, rsp.Error)
+	require.NoError(t, rsp.Body.Close())
+	assert.True(t, body.isClosed())
+	stopped := rsp.Body.(*doneReader).stop()
+	assert.False(t, stopped, "the AfterFunc should already have been stopped")
+	cancel()
+}
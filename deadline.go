@@ -0,0 +1,64 @@
+package typhon
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeader is the header in which PropagateDeadlineFilter sends the time remaining before a request's deadline,
+// in milliseconds. It is relative rather than absolute so that it is unaffected by differences between hosts' clocks.
+const TimeoutHeader = "X-Typhon-Timeout"
+
+// PropagateDeadlineFilter is a client Filter which sends the time remaining before the deadline of each request's
+// context in the TimeoutHeader, so that a server using DeadlineFilter can stop working on it once the client has given
+// up. Requests without a deadline are sent without the header.
+func PropagateDeadlineFilter(req Request, svc Service) Response {
+	if deadline, ok := req.Deadline(); ok {
+		remaining := max(time.Until(deadline), 0)
+		req.Header.Set(TimeoutHeader, strconv.FormatInt(remaining.Milliseconds(), 10))
+	} else {
+		req.Header.Del(TimeoutHeader)
+	}
+	return svc(req)
+}
+
+// A DeadlinePolicy configures DeadlineFilter.
+type DeadlinePolicy struct {
+	// Max is the maximum timeout a client may set; longer timeouts are reduced to it. If it is zero, timeouts aren't
+	// limited.
+	Max time.Duration
+	// Skew is subtracted from the timeouts set by clients, to allow for the time taken for their requests to arrive.
+	Skew time.Duration
+}
+
+// DeadlineFilter returns a server Filter which applies the timeouts sent by clients in the TimeoutHeader (see
+// PropagateDeadlineFilter) to the contexts of their requests. Requests whose timeout has already passed have an expired
+// context, so when the filter is applied outside ExpirationFilter, they are rejected before reaching the handler:
+//
+//	svc = svc.Filter(ExpirationFilter).Filter(DeadlineFilter(DeadlinePolicy{Max: 30 * time.Second}))
+//
+// Requests without a valid header are passed through unchanged.
+func DeadlineFilter(policy DeadlinePolicy) Filter {
+	return func(req Request, svc Service) Response {
+		ms, err := strconv.ParseInt(req.Header.Get(TimeoutHeader), 10, 64)
+		if err != nil || ms < 0 {
+			return svc(req)
+		}
+		// Timeouts too long to be represented are clamped, rather than overflowing
+		ms = min(ms, math.MaxInt64/int64(time.Millisecond))
+		timeout := time.Duration(ms)*time.Millisecond - policy.Skew
+		if policy.Max > 0 && timeout > policy.Max {
+			timeout = policy.Max
+		}
+
+		parent := req.unwrappedContext()
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		req.Context = ctx
+		return cancelWithBody(svc(req), cancel)
+	}
+}
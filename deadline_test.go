@@ -0,0 +1,129 @@
+package typhon
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPropagateDeadlineFilter(t *testing.T) {
+	t.Parallel()
+
+	var header string
+	svc := Service(func(req Request) Response {
+		header = req.Header.Get(TimeoutHeader)
+		return req.Response(nil)
+	}).Filter(PropagateDeadlineFilter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req := NewRequest(ctx, "GET", "/", nil)
+	svc(req)
+	ms, err := strconv.Atoi(header)
+	require.NoError(t, err)
+	assert.InDelta(t, 1000, ms, 100)
+
+	// Requests without deadlines don't send the header
+	req.Context = context.Background()
+	svc(req)
+	assert.Empty(t, header)
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	svc(NewRequest(ctx, "GET", "/", nil))
+	assert.Equal(t, "0", header)
+}
+
+func TestDeadlineFilter(t *testing.T) {
+	t.Parallel()
+
+	var remaining time.Duration
+	var hasDeadline bool
+	svc := Service(func(req Request) Response {
+		var deadline time.Time
+		deadline, hasDeadline = req.Deadline()
+		remaining = time.Until(deadline)
+		return req.Response(nil)
+	}).Filter(ExpirationFilter)
+
+	cases := []struct {
+		name     string
+		header   string
+		policy   DeadlinePolicy
+		expected time.Duration
+	}{
+		{"Timeout", "500", DeadlinePolicy{}, 500 * time.Millisecond},
+		{"Max", "5000", DeadlinePolicy{Max: time.Second}, time.Second},
+		{"Skew", "500", DeadlinePolicy{Skew: 100 * time.Millisecond}, 400 * time.Millisecond},
+		{"Overflow", "9223372036854775807", DeadlinePolicy{Max: time.Second}, time.Second}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := NewRequest(context.Background(), "GET", "/", nil)
+			req.Header.Set(TimeoutHeader, c.header)
+			rsp := svc.Filter(DeadlineFilter(c.policy))(req)
+			require.NoError(t, rsp.Error)
+			require.True(t, hasDeadline)
+			assert.InDelta(t, c.expected, remaining, float64(50*time.Millisecond))
+		})
+	}
+
+	// Requests without a valid header are unaffected
+	for _, header := range []string{"", "soon", "-1"} {
+		req := NewRequest(context.Background(), "GET", "/", nil)
+		req.Header.Set(TimeoutHeader, header)
+		rsp := svc.Filter(DeadlineFilter(DeadlinePolicy{}))(req)
+		require.NoError(t, rsp.Error)
+		assert.False(t, hasDeadline, header)
+	}
+
+	// Timeouts too long to be represented don't overflow, so the request doesn't expire
+	req := NewRequest(context.Background(), "GET", "/", nil)
+	req.Header.Set(TimeoutHeader, "9223372036854775807")
+	rsp := svc.Filter(DeadlineFilter(DeadlinePolicy{}))(req)
+	require.NoError(t, rsp.Error)
+	assert.Greater(t, remaining, 24*time.Hour)
+
+	// Requests which have already expired are rejected by ExpirationFilter
+	called := false
+	expiring := Service(func(req Request) Response {
+		called = true
+		return req.Response(nil)
+	}).Filter(ExpirationFilter).Filter(DeadlineFilter(DeadlinePolicy{Skew: 10 * time.Millisecond}))
+	req = NewRequest(context.Background(), "GET", "/", nil)
+	req.Header.Set(TimeoutHeader, "5")
+	rsp = expiring(req)
+	require.Error(t, rsp.Error)
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrBadRequest))
+	assert.False(t, called)
+}
+
+func TestDeadlineFilterE2E(t *testing.T) {
+	t.Parallel()
+
+	errs := make(chan error, 1)
+	svc := Service(func(req Request) Response {
+		<-req.Done()
+		errs <- req.Err()
+		return req.Response(nil)
+	}).Filter(DeadlineFilter(DeadlinePolicy{Skew: 25 * time.Millisecond}))
+	s, err := Listen(svc, "localhost:0")
+	require.NoError(t, err)
+	defer s.Stop(context.Background())
+
+	// The server's deadline (less the skew) passes before the client gives up and tears down the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	client := Service(BareClient).Filter(PropagateDeadlineFilter)
+	NewRequest(ctx, "GET", "http://"+s.Listener().Addr().String(), nil).Do(client)
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the server didn't observe the deadline")
+	}
+}
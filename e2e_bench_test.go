@@ -4,15 +4,18 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"path/filepath"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
-func BenchmarkRequestResponse(b *testing.B) {
-	b.ReportAllocs()
+// benchmarkService serves a trivial Service, which responds with body, over a unix socket. It returns a Service which
+// sends requests to it.
+func benchmarkService(b *testing.B, body interface{}) Service {
 	svc := Service(func(req Request) Response {
-		rsp := req.Response(nil)
+		rsp := req.Response(body)
 		rsp.Header.Set("a", "b")
 		rsp.Header.Set("b", "b")
 		rsp.Header.Set("c", "b")
@@ -20,25 +23,69 @@ func BenchmarkRequestResponse(b *testing.B) {
 	})
 	addr := &net.UnixAddr{
 		Net:  "unix",
-		Name: "/tmp/typhon-test.sock"}
-	l, _ := net.ListenUnix("unix", addr)
-	defer l.Close()
-	s, _ := Serve(svc, l)
-	defer s.Stop(context.Background())
-
-	conn, err := net.DialUnix("unix", nil, addr)
+		Name: filepath.Join(b.TempDir(), "typhon.sock")}
+	l, err := net.ListenUnix("unix", addr)
 	require.NoError(b, err)
-	defer conn.Close()
+	b.Cleanup(func() { l.Close() })
+	s, err := Serve(svc, l)
+	require.NoError(b, err)
+	b.Cleanup(func() { s.Stop(context.Background()) })
+
 	sockTransport := &http.Transport{
+		MaxIdleConnsPerHost: 100,
 		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
-			return conn, nil
+			return net.DialUnix("unix", nil, addr)
 		}}
+	b.Cleanup(sockTransport.CloseIdleConnections)
+	return HttpService(sockTransport)
+}
 
+func BenchmarkRequestResponse(b *testing.B) {
+	b.ReportAllocs()
+	sockSvc := benchmarkService(b, nil)
 	ctx := context.Background()
 	req := NewRequest(ctx, "GET", "http://localhost/foo", nil)
-	sockSvc := HttpService(sockTransport)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		req.SendVia(sockSvc).Response()
+		rsp := req.SendVia(sockSvc).Response()
+		rsp.Body.Close()
+	}
+}
+
+// BenchmarkRequestResponseDo is like BenchmarkRequestResponse, but sends requests synchronously.
+func BenchmarkRequestResponseDo(b *testing.B) {
+	b.ReportAllocs()
+	sockSvc := benchmarkService(b, nil)
+	ctx := context.Background()
+	req := NewRequest(ctx, "GET", "http://localhost/foo", nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rsp := req.Do(sockSvc)
+		rsp.Body.Close()
+	}
+}
+
+// BenchmarkRequestResponseCancellable sends requests with a cancellable context, so their response bodies are
+// watched for cancellation, and holds batches of them open before closing them. It reports the peak number of
+// goroutines.
+func BenchmarkRequestResponseCancellable(b *testing.B) {
+	b.ReportAllocs()
+	sockSvc := benchmarkService(b, "body")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := NewRequest(ctx, "GET", "http://localhost/foo", nil)
+	rsps := make([]Response, 0, 100)
+	peak := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rsps = append(rsps, req.Do(sockSvc))
+		if len(rsps) == cap(rsps) || i == b.N-1 {
+			peak = max(peak, runtime.NumGoroutine())
+			for _, rsp := range rsps {
+				rsp.Body.Close()
+			}
+			rsps = rsps[:0]
+		}
 	}
+	b.ReportMetric(float64(peak), "goroutines")
 }
@@ -10,6 +10,8 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -859,6 +861,140 @@ func TestE2EForcefulShutdown(t *testing.T) {
 	})
 }
 
+// TestE2EShutdownHooks verifies that shutdown hooks run in order around draining, with their own timeouts, and that
+// their errors are returned from Stop.
+func TestE2EShutdownHooks(t *testing.T) {
+	flavours(t, func(t *testing.T, flav e2eFlavour) {
+		ctx, cancel := flav.Context()
+		defer cancel()
+
+		var m sync.Mutex
+		var events []string
+		record := func(event string) {
+			m.Lock()
+			defer m.Unlock()
+			events = append(events, event)
+		}
+
+		handling, returnRsp := make(chan bool), make(chan bool)
+		svc := Service(func(req Request) Response {
+			handling <- true
+			<-returnRsp
+			record("handled")
+			return NewResponse(req)
+		})
+		svc = svc.Filter(ErrorFilter)
+		s := flav.Serve(svc, WithShutdownHookTimeout(20*time.Millisecond))
+
+		errAfter := errors.New("flush failed")
+		s.OnShutdown(ShutdownAfterDrain, func(ctx context.Context) error {
+			record("after")
+			return errAfter
+		})
+		s.OnShutdown(ShutdownBeforeDrain, func(ctx context.Context) error {
+			select {
+			case <-s.Done():
+			default:
+				t.Error("before-drain hook ran before shutdown began")
+			}
+			record("before")
+			return nil
+		})
+		s.OnShutdown(ShutdownBeforeDrain, func(ctx context.Context) error {
+			<-ctx.Done() // times out
+			record("before-timeout")
+			return ctx.Err()
+		})
+
+		// Send a request, which will hang in the handler until we send to returnRsp
+		req := NewRequest(ctx, "GET", flav.URL(s), nil)
+		rspF := req.Send()
+		<-handling
+
+		stopErr := make(chan error, 1)
+		go func() {
+			stopErr <- s.Stop(ctx)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		returnRsp <- true
+		require.NoError(t, rspF.Response().Error)
+
+		err := <-stopErr
+		require.Error(t, err)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorIs(t, err, errAfter)
+		assert.Equal(t, err, s.Stop(ctx))
+		m.Lock()
+		defer m.Unlock()
+		assert.Equal(t, []string{"before", "before-timeout", "handled", "after"}, events)
+	})
+}
+
+func TestListenAddresses(t *testing.T) {
+	t.Parallel()
+
+	sock := filepath.Join(t.TempDir(), "typhon.sock")
+	cases := []struct {
+		addr    string
+		network string
+	}{
+		{"localhost:0", "tcp"},
+		{"tcp://localhost:0", "tcp"},
+		{"tcp4://127.0.0.1:0", "tcp"},
+		{"unix://" + sock, "unix"}}
+	for _, c := range cases {
+		l, err := NewListener(c.addr)
+		require.NoError(t, err, c.addr)
+		assert.Equal(t, c.network, l.Addr().Network(), c.addr)
+		require.NoError(t, l.Close())
+	}
+
+	_, err := NewListener("udp://localhost:0")
+	assert.Error(t, err)
+	_, err = Listen(Service(BareClient), "unix://"+filepath.Join(t.TempDir(), "missing", "typhon.sock"))
+	assert.Error(t, err)
+}
+
+// TestE2EMultipleListeners verifies that a server can serve on TCP and Unix socket listeners at once, and that they are
+// shut down together.
+func TestE2EMultipleListeners(t *testing.T) {
+	t.Parallel()
+
+	svc := Service(func(req Request) Response {
+		return req.Response("hello")
+	})
+	sock := filepath.Join(t.TempDir(), "typhon.sock")
+	tcpL, err := NewListener("tcp://localhost:0")
+	require.NoError(t, err)
+	unixL, err := NewListener("unix://" + sock)
+	require.NoError(t, err)
+	s, err := ServeListeners(svc, []net.Listener{tcpL, unixL})
+	require.NoError(t, err)
+	assert.Equal(t, []net.Listener{tcpL, unixL}, s.Listeners())
+	assert.Equal(t, tcpL, s.Listener())
+
+	unixClient := HttpService(&http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		}})
+	for _, client := range []Service{BareClient, unixClient} {
+		rsp := NewRequest(context.Background(), "GET", "http://"+tcpL.Addr().String(), nil).Do(client)
+		require.NoError(t, rsp.Error)
+		var body string
+		require.NoError(t, rsp.Decode(&body))
+		assert.Equal(t, "hello", body)
+	}
+
+	require.NoError(t, s.Stop(context.Background()))
+	for _, client := range []Service{BareClient, unixClient} {
+		rsp := NewRequest(context.Background(), "GET", "http://"+tcpL.Addr().String(), nil).Do(client)
+		assert.Error(t, rsp.Error)
+	}
+
+	_, err = ServeListeners(svc, nil)
+	assert.Error(t, err)
+}
+
 func TestE2EServerTimeouts(t *testing.T) {
 	someFlavours(t, []string{
 		"http1.1",
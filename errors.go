@@ -15,6 +15,10 @@ import (
 	terrorsproto "github.com/monzo/terrors/proto"
 )
 
+// ErrMethodNotAllowed is the terror code used by Router when a request's path matches a registered route, but its
+// method does not. ErrorFilter maps it to 405 (Method Not Allowed).
+const ErrMethodNotAllowed = "method_not_allowed"
+
 var (
 	mapTerr2Status = map[string]int{
 		terrors.ErrBadRequest:         http.StatusBadRequest,          // 400
@@ -26,6 +30,8 @@ var (
 		terrors.ErrTimeout:            http.StatusGatewayTimeout,      // 504
 		terrors.ErrUnauthorized:       http.StatusUnauthorized,        // 401
 		terrors.ErrRateLimited:        http.StatusTooManyRequests,     // 429
+		ErrMethodNotAllowed:           http.StatusMethodNotAllowed,    // 405
+		ErrCircuitOpen:                http.StatusServiceUnavailable,  // 503
 	}
 	mapStatus2Terr map[int]string
 )
@@ -0,0 +1,172 @@
+package typhon
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A HealthCheck reports whether some aspect of a service is healthy, returning an error if not.
+type HealthCheck func(ctx context.Context) error
+
+type namedHealthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// Health aggregates a service's health checks, and serves them to probes (eg. from Kubernetes or a load balancer) via
+// its Healthz and Readyz Services:
+//
+//	health := &typhon.Health{}
+//	health.RegisterReadiness("database", db.PingContext)
+//	router.GET("/healthz", health.Healthz())
+//	router.GET("/readyz", health.Readyz())
+//	srv, err := typhon.Listen(router.Serve(), addr, typhon.WithHealth(health), typhon.WithPreStopDelay(5*time.Second))
+//
+// The zero value is ready to use.
+type Health struct {
+	// Timeout bounds the time each check may take. Defaults to 5 seconds.
+	Timeout time.Duration
+
+	m         sync.RWMutex
+	liveness  []namedHealthCheck
+	readiness []namedHealthCheck
+	draining  []<-chan struct{}
+}
+
+// RegisterLiveness adds a check which determines whether the service is alive: if it fails, the service should be
+// restarted. It is also used to determine readiness.
+func (h *Health) RegisterLiveness(name string, check HealthCheck) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.liveness = append(h.liveness, namedHealthCheck{name, check})
+}
+
+// RegisterReadiness adds a check which determines whether the service is ready to receive traffic.
+func (h *Health) RegisterReadiness(name string, check HealthCheck) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.readiness = append(h.readiness, namedHealthCheck{name, check})
+}
+
+// watch makes the service unready once done is closed.
+func (h *Health) watch(done <-chan struct{}) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.draining = append(h.draining, done)
+}
+
+// Draining reports whether any Server to which the Health has been attached (see WithHealth) is shutting down.
+func (h *Health) Draining() bool {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	for _, done := range h.draining {
+		select {
+		case <-done:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// A healthReport is the body of a response from Healthz or Readyz.
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// run runs the checks concurrently, returning whether they all passed, and the outcome of each. Checks which haven't
+// finished within the timeout aren't waited for, and are reported as failing with the context's error.
+func (h *Health) run(ctx context.Context, checks []namedHealthCheck) (bool, map[string]string) {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		i   int
+		err error
+	}
+	// Checks which ignore the context are abandoned once it is done, so the channel is buffered for them to finish
+	done := make(chan result, len(checks))
+	for i, c := range checks {
+		go func(i int, check HealthCheck) {
+			done <- result{i, check(ctx)}
+		}(i, c.check)
+	}
+
+	ok := true
+	results := make(map[string]string, len(checks))
+	finished := make([]bool, len(checks))
+	for pending := len(checks); pending > 0; pending-- {
+		select {
+		case r := <-done:
+			finished[r.i] = true
+			if r.err != nil {
+				ok = false
+				results[checks[r.i].name] = r.err.Error()
+			} else {
+				results[checks[r.i].name] = "ok"
+			}
+		case <-ctx.Done():
+			for i, c := range checks {
+				if !finished[i] {
+					results[c.name] = ctx.Err().Error()
+				}
+			}
+			return false, results
+		}
+	}
+	return ok, results
+}
+
+func (h *Health) respond(req Request, checks []namedHealthCheck, draining bool) Response {
+	ok, results := h.run(req, checks)
+	report := healthReport{
+		Status: "ok",
+		Checks: results}
+	code := http.StatusOK
+	switch {
+	case draining:
+		report.Status, code = "draining", http.StatusServiceUnavailable
+	case !ok:
+		report.Status, code = "failing", http.StatusServiceUnavailable
+	}
+	rsp := NewResponseWithCode(req, code)
+	rsp.Encode(report)
+	return rsp
+}
+
+// Healthz returns a Service which reports whether the service is alive, according to its liveness checks. It responds
+// with 200 (OK) if they all pass, and 503 (Service Unavailable) otherwise, with the outcome of each in the body.
+func (h *Health) Healthz() Service {
+	return func(req Request) Response {
+		h.m.RLock()
+		checks := h.liveness
+		h.m.RUnlock()
+		return h.respond(req, checks, false)
+	}
+}
+
+// Readyz returns a Service which reports whether the service is ready to receive traffic, according to both its
+// liveness and readiness checks. Readiness fails as soon as a Server to which the Health is attached begins to shut
+// down, so that probes stop routing traffic to it before its connections are refused.
+func (h *Health) Readyz() Service {
+	return func(req Request) Response {
+		h.m.RLock()
+		checks := append(h.liveness[:len(h.liveness):len(h.liveness)], h.readiness...)
+		h.m.RUnlock()
+		return h.respond(req, checks, h.Draining())
+	}
+}
+
+// WithHealth attaches a Health to the server, so that its readiness fails as soon as Stop is called.
+func WithHealth(h *Health) ServerOption {
+	return func(s *Server) {
+		h.watch(s.Done())
+	}
+}
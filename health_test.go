@@ -0,0 +1,119 @@
+package typhon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+
+	h := &Health{Timeout: 10 * time.Millisecond}
+	h.RegisterLiveness("alive", func(ctx context.Context) error { return nil })
+	h.RegisterReadiness("database", func(ctx context.Context) error { return errors.New("connection refused") })
+	h.RegisterReadiness("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	rsp := h.Healthz()(NewRequest(context.Background(), "GET", "/healthz", nil))
+	require.NoError(t, rsp.Error)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	report := healthReport{}
+	require.NoError(t, rsp.Decode(&report))
+	assert.Equal(t, healthReport{
+		Status: "ok",
+		Checks: map[string]string{
+			"alive": "ok"}}, report)
+
+	rsp = h.Readyz()(NewRequest(context.Background(), "GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	report = healthReport{}
+	require.NoError(t, rsp.Decode(&report))
+	assert.Equal(t, healthReport{
+		Status: "failing",
+		Checks: map[string]string{
+			"alive":    "ok",
+			"database": "connection refused",
+			"slow":     context.DeadlineExceeded.Error()}}, report)
+
+	// Without any checks, the service is healthy
+	rsp = (&Health{}).Readyz()(NewRequest(context.Background(), "GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+}
+
+func TestHealthUnresponsiveCheck(t *testing.T) {
+	t.Parallel()
+
+	// Checks which ignore their context don't hold up the response beyond the timeout
+	block := make(chan struct{})
+	defer close(block)
+	h := &Health{Timeout: 10 * time.Millisecond}
+	h.RegisterLiveness("alive", func(ctx context.Context) error { return nil })
+	h.RegisterLiveness("stuck", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+
+	start := time.Now()
+	rsp := h.Healthz()(NewRequest(context.Background(), "GET", "/healthz", nil))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	report := healthReport{}
+	require.NoError(t, rsp.Decode(&report))
+	assert.Equal(t, healthReport{
+		Status: "failing",
+		Checks: map[string]string{
+			"alive": "ok",
+			"stuck": context.DeadlineExceeded.Error()}}, report)
+}
+
+func TestHealthDraining(t *testing.T) {
+	t.Parallel()
+
+	h := &Health{}
+	router := Router{}
+	router.GET("/healthz", h.Healthz())
+	router.GET("/readyz", h.Readyz())
+	s, err := Listen(router.Serve(), "localhost:0", WithHealth(h), WithPreStopDelay(200*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Stop(context.Background())
+	probe := func(path string) (int, string) {
+		rsp := NewRequest(context.Background(), "GET", "http://"+s.Listener().Addr().String()+path, nil).Do(BareClient)
+		require.NoError(t, rsp.Error)
+		b, err := rsp.BodyBytes(true)
+		require.NoError(t, err)
+		report := healthReport{}
+		require.NoError(t, json.Unmarshal(b, &report))
+		return rsp.StatusCode, report.Status
+	}
+
+	code, status := probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", status)
+	assert.False(t, h.Draining())
+
+	// Once Stop is called, readiness fails straight away, while the server continues to serve during the delay
+	start := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Stop(context.Background())
+	}()
+	assert.Eventually(t, h.Draining, time.Second, time.Millisecond)
+	code, status = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "draining", status)
+	code, _ = probe("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	<-stopped
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
@@ -0,0 +1,194 @@
+package typhon
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/monzo/terrors"
+)
+
+// A HedgePolicy configures HedgeFilter.
+type HedgePolicy struct {
+	// Delay is how long to wait for a response before sending each hedge. If it is zero, the delay is derived from the
+	// latency of recent responses instead.
+	Delay time.Duration
+	// Percentile is the percentile (between 0 and 1) of the latency of recent successful responses which is used as the
+	// delay when Delay isn't set. Defaults to 0.95.
+	Percentile float64
+	// MaxDelay bounds the delay derived from recent responses, and is used until enough have been observed. Defaults to
+	// 1 second.
+	MaxDelay time.Duration
+	// MaxHedges is the maximum number of hedges sent for each request, in addition to the original. Defaults to 1.
+	MaxHedges int
+	// Methods lists the HTTP methods of requests which may be hedged. Defaults to GET, HEAD and OPTIONS.
+	Methods []string
+}
+
+const (
+	hedgeSamples    = 128 // number of recent latencies from which the delay is derived
+	hedgeMinSamples = 16  // number of latencies which must be observed before the delay is derived from them
+)
+
+// hedgeLatencies records the latencies of recent successful responses.
+type hedgeLatencies struct {
+	m       sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (l *hedgeLatencies) observe(d time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if len(l.samples) < hedgeSamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % hedgeSamples
+}
+
+// percentile returns the pth percentile of the recorded latencies, or false if too few have been recorded.
+func (l *hedgeLatencies) percentile(p float64) (time.Duration, bool) {
+	l.m.Lock()
+	if len(l.samples) < hedgeMinSamples {
+		l.m.Unlock()
+		return 0, false
+	}
+	samples := slices.Clone(l.samples)
+	l.m.Unlock()
+	slices.Sort(samples)
+	return samples[int(p*float64(len(samples)-1))], true
+}
+
+type hedgeResult struct {
+	rsp    Response
+	cancel context.CancelFunc
+	i      int // the index of the copy which produced the response
+}
+
+// HedgeFilter returns a Filter which reduces tail latency by sending further copies ("hedges") of a request if no
+// response is received within a delay, either fixed or derived from the latency of recent responses. The first
+// successful response is returned, and the contexts of the other copies are cancelled (so HttpService closes their
+// bodies.) If a copy fails (with a transport error, a 5xx status or a retryable error), the next hedge is sent
+// immediately; if all of them fail, the last failure is returned. Other errors, like 4xx responses, are returned as
+// they are.
+//
+// Only requests with idempotent methods and replayable bodies (see Request.Replayable) are hedged. Because hedging
+// increases load on the upstream, it is best suited to cheap, read-heavy requests.
+func HedgeFilter(policy HedgePolicy) Filter {
+	if policy.Percentile <= 0 || policy.Percentile > 1 {
+		policy.Percentile = 0.95
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = time.Second
+	}
+	if policy.MaxHedges <= 0 {
+		policy.MaxHedges = 1
+	}
+	if policy.Methods == nil {
+		policy.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	latencies := &hedgeLatencies{}
+
+	delay := func() time.Duration {
+		if policy.Delay > 0 {
+			return policy.Delay
+		}
+		if d, ok := latencies.percentile(policy.Percentile); ok && d < policy.MaxDelay {
+			return d
+		}
+		return policy.MaxDelay
+	}
+
+	return func(req Request, svc Service) Response {
+		if !slices.Contains(policy.Methods, req.Method) || !req.Replayable() {
+			return svc(req)
+		}
+
+		parent := req.Context
+		if parent == nil {
+			parent = context.Background()
+		}
+		results := make(chan hedgeResult, policy.MaxHedges+1)
+		cancels := make([]context.CancelFunc, 0, policy.MaxHedges+1)
+		send := func() {
+			ctx, cancel := context.WithCancel(parent)
+			attempt, i := req.Clone(ctx), len(cancels)
+			cancels = append(cancels, cancel)
+			go func() {
+				start := time.Now()
+				rsp := svc(attempt)
+				if hedgeSucceeded(rsp) {
+					latencies.observe(time.Since(start))
+				}
+				results <- hedgeResult{rsp, cancel, i}
+			}()
+		}
+
+		send()
+		sent, pending := 1, 1
+		timer := time.NewTimer(delay())
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				if sent <= policy.MaxHedges {
+					send()
+					sent++
+					pending++
+					timer.Reset(delay())
+				}
+			case r := <-results:
+				pending--
+				if !hedgeSucceeded(r.rsp) && (pending > 0 || sent <= policy.MaxHedges) {
+					discardHedge(r)
+					if sent <= policy.MaxHedges {
+						send()
+						sent++
+						pending++
+						timer.Reset(delay())
+					}
+					continue
+				}
+				// This is the winner: the others are cancelled, and their responses discarded when they arrive
+				for i, cancel := range cancels {
+					if i != r.i {
+						cancel()
+					}
+				}
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						discardHedge(<-results)
+					}
+				}(pending)
+				return cancelWithBody(r.rsp, r.cancel)
+			}
+		}
+	}
+}
+
+// hedgeSucceeded reports whether a response should be returned in preference to waiting for a hedge. Failures are
+// transport errors, 5xx responses and retryable errors: other errors (like 4xx responses) are answers in their own
+// right, which a hedge would only repeat.
+func hedgeSucceeded(rsp Response) bool {
+	switch {
+	case rsp.Response == nil:
+		return rsp.Error == nil
+	case rsp.StatusCode >= 500:
+		return false
+	case rsp.StatusCode >= 400, rsp.Error == nil:
+		return true
+	default:
+		return !terrors.IsRetryable(rsp.Error)
+	}
+}
+
+func discardHedge(r hedgeResult) {
+	r.cancel()
+	if r.rsp.Response != nil && r.rsp.Body != nil {
+		r.rsp.Body.Close()
+	}
+}
@@ -0,0 +1,171 @@
+package typhon
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgeFilter(t *testing.T) {
+	t.Parallel()
+
+	// The first copy of each request hangs until it's cancelled; the others respond immediately
+	var attempts, cancelled int32
+	svc := Service(func(req Request) Response {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-req.Done()
+			atomic.AddInt32(&cancelled, 1)
+			rsp := NewResponse(req)
+			rsp.Error = req.Err()
+			return rsp
+		}
+		return req.Response("hedge")
+	}).Filter(HedgeFilter(HedgePolicy{
+		Delay: 10 * time.Millisecond}))
+
+	rsp := svc(NewRequest(context.Background(), "GET", "/", nil))
+	require.NoError(t, rsp.Error)
+	var body string
+	require.NoError(t, rsp.Decode(&body))
+	assert.Equal(t, "hedge", body)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&attempts))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&cancelled) == 1
+	}, time.Second, time.Millisecond)
+
+	// Requests which respond quickly aren't hedged
+	rsp = svc(NewRequest(context.Background(), "GET", "/", nil))
+	require.NoError(t, rsp.Error)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+}
+
+func TestHedgeFilterIdempotency(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	svc := Service(func(req Request) Response {
+		atomic.AddInt32(&attempts, 1)
+		time.Sleep(20 * time.Millisecond)
+		return req.Response(nil)
+	}).Filter(HedgeFilter(HedgePolicy{
+		Delay: time.Millisecond}))
+
+	svc(NewRequest(context.Background(), "POST", "/", nil))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&attempts))
+	svc(NewRequest(context.Background(), "GET", "/", io.NopCloser(strings.NewReader("streaming"))))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&attempts))
+}
+
+func TestHedgeFilterFailures(t *testing.T) {
+	t.Parallel()
+
+	// Failures cause the next hedge to be sent immediately, and the last failure is returned if all of them fail
+	var attempts int32
+	svc := Service(func(req Request) Response {
+		atomic.AddInt32(&attempts, 1)
+		return NewResponseWithCode(req, http.StatusServiceUnavailable)
+	}).Filter(HedgeFilter(HedgePolicy{
+		Delay:     time.Hour,
+		MaxHedges: 2}))
+	rsp := svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+
+	atomic.StoreInt32(&attempts, 0)
+	svc = Service(func(req Request) Response {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			rsp := NewResponse(req)
+			rsp.Error = terrors.InternalService("", "", nil)
+			return rsp
+		}
+		return req.Response(nil)
+	}).Filter(HedgeFilter(HedgePolicy{
+		Delay: time.Hour}))
+	rsp = svc(NewRequest(context.Background(), "GET", "/", nil))
+	require.NoError(t, rsp.Error)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&attempts))
+
+	// Errors which aren't failures of the upstream are returned without sending a hedge
+	for _, err := range []error{
+		terrors.NotFound("missing", "Not here", nil),
+		terrors.BadRequest("invalid", "Bad request", nil)} {
+		atomic.StoreInt32(&attempts, 0)
+		svc = Service(func(req Request) Response {
+			atomic.AddInt32(&attempts, 1)
+			rsp := NewResponse(req)
+			rsp.Error = err
+			return rsp
+		}).Filter(ErrorFilter).Filter(HedgeFilter(HedgePolicy{
+			Delay:     time.Hour,
+			MaxHedges: 2}))
+		rsp = svc(NewRequest(context.Background(), "GET", "/", nil))
+		require.Error(t, rsp.Error)
+		assert.GreaterOrEqual(t, rsp.StatusCode, 400)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&attempts), err.Error())
+	}
+}
+
+func TestHedgeFilterObservedLatency(t *testing.T) {
+	t.Parallel()
+
+	var slow int32
+	var attempts int32
+	svc := Service(func(req Request) Response {
+		n := atomic.AddInt32(&attempts, 1)
+		if atomic.LoadInt32(&slow) == 1 && n%2 == 1 {
+			select {
+			case <-req.Done():
+			case <-time.After(time.Second):
+			}
+		}
+		return req.Response(nil)
+	}).Filter(HedgeFilter(HedgePolicy{
+		MaxDelay: time.Hour}))
+
+	for i := 0; i < hedgeMinSamples; i++ {
+		svc(NewRequest(context.Background(), "GET", "/", nil))
+	}
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&slow, 1)
+
+	// Having observed fast responses, the filter hedges the slow one quickly
+	start := time.Now()
+	rsp := svc(NewRequest(context.Background(), "GET", "/", nil))
+	require.NoError(t, rsp.Error)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&attempts))
+}
+
+func TestHedgeFilterE2E(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	svc := Service(func(req Request) Response {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			select {
+			case <-req.Done():
+			case <-time.After(time.Second):
+			}
+		}
+		return req.Response("ok")
+	})
+	s, err := Listen(svc, "localhost:0")
+	require.NoError(t, err)
+	defer s.Stop(context.Background())
+
+	client := Service(BareClient).Filter(HedgeFilter(HedgePolicy{
+		Delay: 10 * time.Millisecond})).Filter(ErrorFilter)
+	rsp := NewRequest(context.Background(), "GET", "http://"+s.Listener().Addr().String(), nil).SendVia(client).Response()
+	require.NoError(t, rsp.Error)
+	var body string
+	require.NoError(t, rsp.Decode(&body))
+	assert.Equal(t, "ok", body)
+}
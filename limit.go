@@ -0,0 +1,205 @@
+package typhon
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monzo/terrors"
+)
+
+// ErrOverloaded is the terror code used by ConcurrencyLimitFilter when it sheds a request. As a rate_limited code,
+// ErrorFilter maps it to 429 (Too Many Requests).
+const ErrOverloaded = terrors.ErrRateLimited + ".overloaded"
+
+// PriorityHeader is the header from which ConcurrencyLimitFilter reads the Priority of requests: one of "critical",
+// "default" or "sheddable".
+const PriorityHeader = "X-Typhon-Priority"
+
+// A Priority determines the share of a ConcurrencyLimitFilter's limit available to a request.
+type Priority int
+
+const (
+	// PrioritySheddable requests are shed first: they are admitted only while fewer than half of the limit is in use.
+	PrioritySheddable Priority = iota - 1
+	// PriorityDefault requests are admitted while fewer than 90% of the limit is in use. Requests without a (valid)
+	// priority have this priority.
+	PriorityDefault
+	// PriorityCritical requests are admitted while any of the limit remains.
+	PriorityCritical
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySheddable:
+		return "sheddable"
+	case PriorityDefault:
+		return "default"
+	case PriorityCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+// share returns the proportion of the limit available to requests of the priority.
+func (p Priority) share() float64 {
+	switch {
+	case p >= PriorityCritical:
+		return 1
+	case p <= PrioritySheddable:
+		return 0.5
+	default:
+		return 0.9
+	}
+}
+
+// requestPriority returns the Priority of a request, from its PriorityHeader.
+func requestPriority(req Request) Priority {
+	switch strings.ToLower(req.Header.Get(PriorityHeader)) {
+	case "critical":
+		return PriorityCritical
+	case "sheddable":
+		return PrioritySheddable
+	default:
+		return PriorityDefault
+	}
+}
+
+// A ConcurrencyLimitPolicy configures ConcurrencyLimitFilter.
+type ConcurrencyLimitPolicy struct {
+	// InitialLimit is the concurrency limit before it has adapted to observed latencies. Defaults to 20.
+	InitialLimit int
+	// MinLimit and MaxLimit bound the concurrency limit. They default to 1 and 1000.
+	MinLimit, MaxLimit int
+	// Latency is the latency above which the limit is decreased. If it is zero, the limit is decreased when the recent
+	// average latency exceeds twice the long-term average (so that the quickest requests, eg. to health checks, don't
+	// set the baseline for the others.)
+	Latency time.Duration
+	// Backoff is the factor by which the limit is multiplied when it is decreased. Defaults to 0.9.
+	Backoff float64
+	// RetryAfter is sent in the Retry-After header of shed requests. Defaults to 1 second.
+	RetryAfter time.Duration
+	// OnLimitChange, if set, is called whenever the (whole number) limit changes. It must not block, and may be called
+	// concurrently.
+	OnLimitChange func(limit int)
+}
+
+// The weights given to each sample in the short- and long-term moving averages of latency, used when no Latency is
+// configured. Until enough samples have been observed, each average is the mean of all of them, and latency isn't
+// considered high until there have been concurrencyLimitWarmup samples.
+const (
+	concurrencyLimitShortWeight = 0.2
+	concurrencyLimitLongWeight  = 0.02
+	concurrencyLimitWarmup      = 10
+)
+
+type concurrencyLimiter struct {
+	p        *ConcurrencyLimitPolicy
+	m        sync.Mutex
+	limit    float64
+	inflight int
+	samples  int
+	short    float64 // the short-term moving average of latency, in nanoseconds
+	long     float64 // the long-term moving average of latency, in nanoseconds
+}
+
+// acquire reports whether a request of the given priority may be admitted, and if so counts it as in flight.
+func (l *concurrencyLimiter) acquire(p Priority) (bool, int) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if float64(l.inflight) >= math.Max(1, l.limit*p.share()) {
+		return false, int(l.limit)
+	}
+	l.inflight++
+	return true, int(l.limit)
+}
+
+// release accounts for the completion of a request, adjusting the limit: it is decreased multiplicatively when latency
+// is high or the request was dropped, and increased additively when it is in use and latency is low. It returns the
+// new limit, and whether it has changed.
+func (l *concurrencyLimiter) release(latency time.Duration, dropped bool) (int, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	inflight := l.inflight
+	l.inflight--
+	before := int(l.limit)
+
+	high := l.p.Latency > 0 && latency > l.p.Latency
+	if l.p.Latency <= 0 {
+		l.samples++
+		weight := func(w float64) float64 {
+			return math.Max(w, 1/float64(l.samples))
+		}
+		l.short += (float64(latency) - l.short) * weight(concurrencyLimitShortWeight)
+		// The recent average is compared with the long-term average before it takes this sample into account
+		high = l.samples > concurrencyLimitWarmup && l.short > 2*l.long
+		l.long += (float64(latency) - l.long) * weight(concurrencyLimitLongWeight)
+	}
+
+	switch {
+	case dropped || high:
+		l.limit = math.Max(float64(l.p.MinLimit), l.limit*l.p.Backoff)
+	case float64(inflight*2) >= l.limit:
+		l.limit = math.Min(float64(l.p.MaxLimit), l.limit+1)
+	}
+	return int(l.limit), int(l.limit) != before
+}
+
+// ConcurrencyLimitFilter returns a server Filter which sheds load adaptively, so that requests don't queue without
+// bound when a service is overloaded. It limits the number of requests in flight, adjusting the limit according to
+// their latency: additively increasing it while latency is low, and multiplicatively decreasing it when latency rises
+// (or requests time out.)
+//
+// Requests are admitted according to their priority, read from the PriorityHeader: sheddable requests are rejected
+// first, and critical requests last. Rejected requests fail with an ErrOverloaded error and a Retry-After header.
+func ConcurrencyLimitFilter(policy ConcurrencyLimitPolicy) Filter {
+	p := &policy
+	if p.MinLimit <= 0 {
+		p.MinLimit = 1
+	}
+	if p.MaxLimit <= 0 {
+		p.MaxLimit = 1000
+	}
+	if p.MaxLimit < p.MinLimit {
+		p.MaxLimit = p.MinLimit
+	}
+	if p.InitialLimit <= 0 {
+		p.InitialLimit = 20
+	}
+	p.InitialLimit = min(max(p.InitialLimit, p.MinLimit), p.MaxLimit)
+	if p.Backoff <= 0 || p.Backoff >= 1 {
+		p.Backoff = 0.9
+	}
+	if p.RetryAfter <= 0 {
+		p.RetryAfter = time.Second
+	}
+	retryAfter := strconv.Itoa(int(math.Ceil(p.RetryAfter.Seconds())))
+	l := &concurrencyLimiter{
+		p:     p,
+		limit: float64(p.InitialLimit)}
+
+	return func(req Request, svc Service) Response {
+		priority := requestPriority(req)
+		ok, limit := l.acquire(priority)
+		if !ok {
+			rsp := NewResponse(req)
+			rsp.Header.Set("Retry-After", retryAfter)
+			rsp.Error = terrors.New(ErrOverloaded, "Server is overloaded", map[string]string{
+				"limit":    strconv.Itoa(limit),
+				"priority": priority.String()})
+			return rsp
+		}
+
+		start := time.Now()
+		rsp := svc(req)
+		dropped := req.Err() != nil || terrors.Is(rsp.Error, terrors.ErrTimeout)
+		if limit, changed := l.release(time.Since(start), dropped); changed && p.OnLimitChange != nil {
+			p.OnLimitChange(limit)
+		}
+		return rsp
+	}
+}
@@ -0,0 +1,161 @@
+package typhon
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimitFilterPriorities(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	inner, inflight := blockingService(release)
+	svc := inner.Filter(ConcurrencyLimitFilter(ConcurrencyLimitPolicy{
+		InitialLimit: 10,
+		MinLimit:     10,
+		MaxLimit:     10,
+		RetryAfter:   2 * time.Second})).Filter(ErrorFilter)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	send := func(priority string) Response {
+		req := NewRequest(context.Background(), "GET", "/", nil)
+		req.Header.Set(PriorityHeader, priority)
+		return svc(req)
+	}
+	// fill sends requests with the priority until they are rejected, returning the number in flight
+	fill := func(priority string) int32 {
+		for {
+			n := atomic.LoadInt32(inflight)
+			done := make(chan Response, 1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				done <- send(priority)
+			}()
+			deadline := time.After(time.Second)
+			for admitted := false; !admitted; {
+				select {
+				case rsp := <-done:
+					require.Error(t, rsp.Error)
+					assert.True(t, terrors.Is(rsp.Error, ErrOverloaded))
+					assert.Equal(t, http.StatusTooManyRequests, rsp.StatusCode)
+					assert.Equal(t, "2", rsp.Header.Get("Retry-After"))
+					return n
+				case <-deadline:
+					t.Fatal("request neither admitted nor rejected")
+				case <-time.After(time.Millisecond):
+					admitted = atomic.LoadInt32(inflight) > n
+				}
+			}
+		}
+	}
+
+	assert.EqualValues(t, 5, fill("sheddable"))
+	assert.EqualValues(t, 9, fill(""))
+	assert.EqualValues(t, 10, fill("CRITICAL"))
+}
+
+func TestConcurrencyLimitFilterAdapts(t *testing.T) {
+	t.Parallel()
+
+	var m sync.Mutex
+	var limits []int
+	var delay atomic.Int64
+	svc := Service(func(req Request) Response {
+		time.Sleep(time.Duration(delay.Load()))
+		return req.Response(nil)
+	}).Filter(ConcurrencyLimitFilter(ConcurrencyLimitPolicy{
+		InitialLimit: 2,
+		MinLimit:     1,
+		Latency:      5 * time.Millisecond,
+		OnLimitChange: func(limit int) {
+			m.Lock()
+			defer m.Unlock()
+			limits = append(limits, limit)
+		}}))
+
+	// While latency is low and the limit is in use, it increases
+	svc(NewRequest(context.Background(), "GET", "/", nil))
+	m.Lock()
+	assert.Equal(t, []int{3}, limits)
+	limits = nil
+	m.Unlock()
+
+	// When latency is high, it decreases, down to the minimum
+	delay.Store(int64(10 * time.Millisecond))
+	for i := 0; i < 20; i++ {
+		svc(NewRequest(context.Background(), "GET", "/", nil))
+	}
+	m.Lock()
+	assert.Equal(t, []int{2, 1}, limits)
+	m.Unlock()
+}
+
+func TestConcurrencyLimitFilterBaseline(t *testing.T) {
+	t.Parallel()
+
+	// Without a configured latency, the limit decreases when requests take much longer than usual
+	var delay atomic.Int64
+	var limit atomic.Int64
+	svc := Service(func(req Request) Response {
+		time.Sleep(time.Duration(delay.Load()))
+		return req.Response(nil)
+	}).Filter(ConcurrencyLimitFilter(ConcurrencyLimitPolicy{
+		InitialLimit:  5,
+		OnLimitChange: func(l int) { limit.Store(int64(l)) }}))
+
+	delay.Store(int64(5 * time.Millisecond))
+	for i := 0; i < 20; i++ {
+		svc(NewRequest(context.Background(), "GET", "/", nil))
+	}
+	assert.Zero(t, limit.Load())
+	delay.Store(int64(50 * time.Millisecond))
+	svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.EqualValues(t, 4, limit.Load())
+
+	// Requests which are cancelled also decrease the limit
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	delay.Store(int64(5 * time.Millisecond))
+	for i := 0; i < 2; i++ {
+		svc(NewRequest(ctx, "GET", "/", nil))
+	}
+	assert.EqualValues(t, 3, limit.Load())
+}
+
+func TestConcurrencyLimitFilterMixedLatencies(t *testing.T) {
+	t.Parallel()
+
+	// Quick requests (eg. health checks) don't set the baseline for slower ones, so healthy traffic isn't shed
+	var changes []int
+	svc := Service(func(req Request) Response {
+		if req.URL.Path == "/slow" {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return req.Response(nil)
+	}).Filter(ConcurrencyLimitFilter(ConcurrencyLimitPolicy{
+		OnLimitChange: func(l int) { changes = append(changes, l) }}))
+
+	svc(NewRequest(context.Background(), "GET", "/healthz", nil))
+	for i := 0; i < 40; i++ {
+		svc(NewRequest(context.Background(), "GET", "/slow", nil))
+	}
+	for i := 0; i < 40; i++ {
+		path := "/slow"
+		if i%2 == 0 {
+			path = "/healthz"
+		}
+		svc(NewRequest(context.Background(), "GET", path, nil))
+	}
+	assert.Empty(t, changes)
+}
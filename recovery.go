@@ -0,0 +1,54 @@
+package typhon
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+)
+
+// A RecoveryPolicy configures RecoveryFilter.
+type RecoveryPolicy struct {
+	// Redact omits the panic value and stack trace from the error's params, so that they (and any request data or
+	// secrets they contain) aren't disclosed to callers. They are logged regardless.
+	Redact bool
+}
+
+// RecoveryFilter returns a server Filter which recovers from panics in the Service, so that rather than the connection
+// (or stream) being torn down, the caller receives a non-retryable internal_service error. The panic is logged with the
+// request and its stack trace.
+//
+// Panics with http.ErrAbortHandler are re-panicked, so that handlers can still abort responses intentionally. Panics
+// while a streaming response body is being sent, after the Service has returned, aren't recovered.
+func RecoveryFilter(policy RecoveryPolicy) Filter {
+	return func(req Request, svc Service) (rsp Response) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+
+			stack := string(debug.Stack())
+			slog.Error(req, "Recovered from panic: %v", v, map[string]string{
+				"stack": stack})
+			params := map[string]string{}
+			if !policy.Redact {
+				params["panic"] = fmt.Sprint(v)
+				params["stack"] = stack
+			}
+			terr := terrors.InternalService("panic", "Service panicked", params)
+			// A panic is likely to recur if the request is retried
+			retryable := false
+			terr.IsRetryable = &retryable
+			rsp = NewResponse(req)
+			rsp.Error = terr
+		}()
+		return svc(req)
+	}
+}
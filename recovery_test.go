@@ -0,0 +1,98 @@
+package typhon
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capturingLogger is a slog.Logger which records the events logged.
+type capturingLogger struct {
+	m      sync.Mutex
+	events []slog.Event
+}
+
+func (l *capturingLogger) Log(evs ...slog.Event) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.events = append(l.events, evs...)
+}
+
+func (l *capturingLogger) Flush() error {
+	return nil
+}
+
+// TestRecoveryFilter isn't parallel, as it replaces the default logger.
+func TestRecoveryFilter(t *testing.T) {
+	logger := &capturingLogger{}
+	previous := slog.DefaultLogger()
+	slog.SetDefaultLogger(logger)
+	defer slog.SetDefaultLogger(previous)
+
+	panicking := Service(func(req Request) Response {
+		panic("oh no")
+	})
+	req := NewRequest(context.Background(), "GET", "/", nil)
+	rsp := panicking.Filter(RecoveryFilter(RecoveryPolicy{}))(req)
+	require.Error(t, rsp.Error)
+	terr := rsp.Error.(*terrors.Error)
+	assert.True(t, terr.PrefixMatches(terrors.ErrInternalService))
+	assert.Equal(t, "oh no", terr.Params["panic"])
+	assert.Contains(t, terr.Params["stack"], "TestRecoveryFilter")
+	assert.NotContains(t, terr.Message, "oh no")
+	assert.False(t, terrors.IsRetryable(terr))
+
+	require.Len(t, logger.events, 1)
+	assert.Equal(t, slog.ErrorSeverity, logger.events[0].Severity)
+	assert.Contains(t, logger.events[0].Message, "oh no")
+	assert.Contains(t, logger.events[0].Metadata["stack"], "TestRecoveryFilter")
+
+	// The panic and stack can be redacted from the error
+	rsp = panicking.Filter(RecoveryFilter(RecoveryPolicy{Redact: true}))(req)
+	require.Error(t, rsp.Error)
+	terr = rsp.Error.(*terrors.Error)
+	assert.Empty(t, terr.Params)
+	assert.NotContains(t, terr.Message, "oh no")
+
+	// Services which don't panic are unaffected
+	rsp = Service(func(req Request) Response {
+		return req.Response("ok")
+	}).Filter(RecoveryFilter(RecoveryPolicy{}))(req)
+	assert.NoError(t, rsp.Error)
+
+	// Intentional aborts are re-panicked
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		Service(func(req Request) Response {
+			panic(http.ErrAbortHandler)
+		}).Filter(RecoveryFilter(RecoveryPolicy{}))(req)
+	})
+}
+
+func TestRecoveryFilterE2E(t *testing.T) {
+	t.Parallel()
+
+	svc := Service(func(req Request) Response {
+		var m map[string]string
+		m["boom"] = "" // panics
+		return req.Response(nil)
+	}).Filter(RecoveryFilter(RecoveryPolicy{})).Filter(ErrorFilter)
+	s, err := Listen(svc, "localhost:0")
+	require.NoError(t, err)
+	defer s.Stop(context.Background())
+
+	client := Service(BareClient).Filter(ErrorFilter)
+	rsp := NewRequest(context.Background(), "GET", "http://"+s.Listener().Addr().String(), nil).Do(client)
+	require.Error(t, rsp.Error)
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+	terr := rsp.Error.(*terrors.Error)
+	assert.True(t, terr.PrefixMatches(terrors.ErrInternalService))
+	assert.True(t, strings.Contains(terr.Params["panic"], "nil map"))
+	assert.False(t, terrors.IsRetryable(terr))
+}
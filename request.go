@@ -1,6 +1,7 @@
 package typhon
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -180,6 +181,42 @@ func (r *Request) BodyBytes(consume bool) ([]byte, error) {
 	}
 }
 
+// Replayable reports whether the request's body can be sent more than once: that is, whether it is empty or is
+// buffered (as it is when produced by NewRequest or Encode). Streaming bodies can only be read once.
+func (r Request) Replayable() bool {
+	switch r.Body.(type) {
+	case nil, *bufCloser:
+		return true
+	default:
+		return r.Body == http.NoBody
+	}
+}
+
+// Clone returns a copy of the request with the given context, so that it can be sent again (eg. to retry it.) If ctx
+// is nil, the request's existing context is kept.
+//
+// The headers, URL and other fields of the underlying http.Request are copied deeply, so changes to the clone don't
+// affect the original. A buffered body is shared by the clone, which reads it independently from its current offset;
+// a streaming body is shared as it is, so the clone and the original can't both read it (see Replayable.)
+func (r Request) Clone(ctx context.Context) Request {
+	if ctx == nil {
+		ctx = r.Context
+	}
+	httpCtx := ctx
+	if httpCtx == nil {
+		httpCtx = context.Background()
+	}
+	clone := r
+	clone.Context = ctx
+	clone.Request = *r.Request.Clone(httpCtx)
+	if buf, ok := r.Body.(*bufCloser); ok {
+		b := buf.Bytes()
+		// Limit the capacity of the shared slice, so a write to either body can't overwrite the other's
+		clone.Body = &bufCloser{Buffer: *bytes.NewBuffer(b[:len(b):len(b)])}
+	}
+	return clone
+}
+
 // Send round-trips the request via the default Client. It does not block, instead returning a ResponseFuture
 // representing the asynchronous operation to produce the response. It is equivalent to:
 //
@@ -194,6 +231,13 @@ func (r Request) SendVia(svc Service) *ResponseFuture {
 	return SendVia(r, svc)
 }
 
+// Do round-trips the request via the passed Service, blocking until the response is available. It is equivalent to:
+//
+//	Do(r, svc)
+func (r Request) Do(svc Service) Response {
+	return Do(r, svc)
+}
+
 // Response constructs a new Response to the request, and if non-nil, encodes the given body into it.
 func (r Request) Response(body interface{}) Response {
 	rsp := NewResponse(r)
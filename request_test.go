@@ -317,3 +317,47 @@ func jsonStreamMarshal(v interface{}) ([]byte, error) {
 
 	return buffer.Bytes(), nil
 }
+
+func TestRequestClone(t *testing.T) {
+	t.Parallel()
+
+	type ctxKey struct{}
+	req := NewRequest(context.Background(), "POST", "http://example.com/foo?a=b", map[string]string{"a": "b"})
+	req.Header.Set("X-Foo", "bar")
+	assert.True(t, req.Replayable())
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "clone")
+	clone := req.Clone(ctx)
+	assert.True(t, clone.Replayable())
+	assert.Equal(t, "clone", clone.Value(ctxKey{}))
+	assert.Equal(t, ctx, clone.Request.Context())
+	assert.Equal(t, req.ContentLength, clone.ContentLength)
+
+	// Changes to the clone's headers and URL don't affect the original
+	clone.Header.Set("X-Foo", "baz")
+	clone.URL.Path = "/bar"
+	assert.Equal(t, "bar", req.Header.Get("X-Foo"))
+	assert.Equal(t, "/foo", req.URL.Path)
+
+	// Both bodies can be read independently, and writing to one doesn't affect the other
+	clone.Write([]byte("more"))
+	b, err := clone.BodyBytes(true)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":"b"}`+"\nmore", string(b))
+	other := req.Clone(nil)
+	b, err = other.BodyBytes(true)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":"b"}`+"\n", string(b))
+	b, err = req.BodyBytes(true)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":"b"}`+"\n", string(b))
+
+	// Unexported fields are copied too
+	bad := NewRequest(context.Background(), "GET", "%", nil)
+	assert.Error(t, bad.Clone(context.Background()).err)
+
+	streaming := NewRequest(context.Background(), "POST", "/", ioutil.NopCloser(strings.NewReader("foo")))
+	assert.False(t, streaming.Replayable())
+	assert.False(t, streaming.Clone(context.Background()).Replayable())
+	assert.True(t, NewRequest(context.Background(), "GET", "/", http.NoBody).Replayable())
+}
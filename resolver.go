@@ -0,0 +1,128 @@
+package typhon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Resolver resolves the name of a service to the addresses (host:port) of its endpoints.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) ([]string, error)
+}
+
+// StaticResolver is a Resolver which resolves names from a fixed map of names to endpoints.
+type StaticResolver map[string][]string
+
+// Resolve implements Resolver.
+func (r StaticResolver) Resolve(ctx context.Context, name string) ([]string, error) {
+	endpoints, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("no endpoints for %s", name)
+	}
+	return endpoints, nil
+}
+
+// DNSResolver is a Resolver which looks names up in DNS. Names with a port (like users.example.com:8080) are resolved
+// to the addresses of their A and AAAA records, with that port; names without (like _http._tcp.users.example.com) are
+// resolved from their SRV records.
+type DNSResolver struct {
+	// Resolver performs the lookups. Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+// Resolve implements Resolver.
+func (r DNSResolver) Resolve(ctx context.Context, name string) ([]string, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if host, port, err := net.SplitHostPort(name); err == nil {
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		endpoints := make([]string, len(addrs))
+		for i, addr := range addrs {
+			endpoints[i] = net.JoinHostPort(addr, port)
+		}
+		return endpoints, nil
+	}
+
+	_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, len(srvs))
+	for i, srv := range srvs {
+		endpoints[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+	}
+	return endpoints, nil
+}
+
+// A FileResolver is a Resolver which resolves names from a JSON file, which maps names to lists of endpoints like:
+//
+//	{"users": ["10.0.0.1:8080", "10.0.0.2:8080"]}
+//
+// The file is read again whenever it changes, so endpoints can be updated without restarting.
+type FileResolver struct {
+	path      string
+	interval  time.Duration
+	m         sync.Mutex
+	checked   time.Time // when the file was last checked for changes
+	modified  time.Time // the modification time of the file when it was last read
+	endpoints map[string][]string
+}
+
+// NewFileResolver returns a FileResolver which reads the file at path, checking it for changes at most once per
+// interval.
+func NewFileResolver(path string, interval time.Duration) *FileResolver {
+	return &FileResolver{
+		path:     path,
+		interval: interval}
+}
+
+// Resolve implements Resolver.
+func (r *FileResolver) Resolve(ctx context.Context, name string) ([]string, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.endpoints == nil || time.Since(r.checked) >= r.interval {
+		if err := r.reload(); err != nil && r.endpoints == nil {
+			return nil, err
+		}
+	}
+	endpoints, ok := r.endpoints[name]
+	if !ok {
+		return nil, fmt.Errorf("no endpoints for %s in %s", name, r.path)
+	}
+	return endpoints, nil
+}
+
+// reload reads the file if it has changed. If it can't be read, the endpoints read previously are kept.
+func (r *FileResolver) reload() error {
+	r.checked = time.Now()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	if r.endpoints != nil && info.ModTime().Equal(r.modified) {
+		return nil
+	}
+	b, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	endpoints := map[string][]string{}
+	if err := json.Unmarshal(b, &endpoints); err != nil {
+		return fmt.Errorf("parsing %s: %w", r.path, err)
+	}
+	r.endpoints, r.modified = endpoints, info.ModTime()
+	return nil
+}
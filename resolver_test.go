@@ -0,0 +1,67 @@
+package typhon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticResolver(t *testing.T) {
+	t.Parallel()
+
+	r := StaticResolver{
+		"users": {"10.0.0.1:8080", "10.0.0.2:8080"}}
+	endpoints, err := r.Resolve(context.Background(), "users")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, endpoints)
+	_, err = r.Resolve(context.Background(), "accounts")
+	assert.Error(t, err)
+}
+
+func TestDNSResolver(t *testing.T) {
+	t.Parallel()
+
+	endpoints, err := DNSResolver{}.Resolve(context.Background(), "localhost:8080")
+	require.NoError(t, err)
+	require.NotEmpty(t, endpoints)
+	for _, e := range endpoints {
+		assert.Contains(t, []string{"127.0.0.1:8080", "[::1]:8080"}, e)
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"users": ["10.0.0.1:8080"]}`), 0o644))
+	r := NewFileResolver(path, 0)
+
+	endpoints, err := r.Resolve(context.Background(), "users")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, endpoints)
+	_, err = r.Resolve(context.Background(), "accounts")
+	assert.Error(t, err)
+
+	// Changes to the file are picked up
+	require.NoError(t, os.WriteFile(path, []byte(`{"users": ["10.0.0.1:8080", "10.0.0.2:8080"]}`), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	endpoints, err = r.Resolve(context.Background(), "users")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, endpoints)
+
+	// If the file becomes invalid, the previous endpoints are kept
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0o644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	endpoints, err = r.Resolve(context.Background(), "users")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, endpoints)
+
+	// A missing file is an error
+	_, err = NewFileResolver(filepath.Join(t.TempDir(), "missing.json"), time.Second).Resolve(context.Background(), "users")
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+package typhon
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/monzo/terrors"
+)
+
+// DefaultRetryPolicy is used by RetryFilter for any fields of a RetryPolicy which aren't set.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:   3,
+	BaseBackoff:   25 * time.Millisecond,
+	MaxBackoff:    time.Second,
+	MaxRetryAfter: 10 * time.Second,
+	Statuses: []int{
+		http.StatusTooManyRequests,    // 429
+		http.StatusBadGateway,         // 502
+		http.StatusServiceUnavailable, // 503
+		http.StatusGatewayTimeout},    // 504
+	Methods: []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodOptions,
+		http.MethodTrace,
+		http.MethodPut,
+		http.MethodDelete}}
+
+// A RetryPolicy configures RetryFilter. Any fields which aren't set take their values from DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is attempted, including the first attempt.
+	MaxAttempts int
+	// BaseBackoff is the maximum delay before the first retry. It doubles with each subsequent retry, up to MaxBackoff.
+	// The actual delay is chosen at random up to this maximum (ie. with "full jitter"), so that clients which fail at
+	// the same time don't retry at the same time.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// MaxRetryAfter is the longest delay requested by a response's Retry-After header which is honoured. If a response
+	// requests a longer delay, it is returned rather than retried.
+	MaxRetryAfter time.Duration
+	// Codes lists the terror codes of errors which are retried, matched as by terrors.Is. If it is nil, errors are
+	// retried if terrors.IsRetryable reports that they are.
+	Codes []string
+	// Statuses lists the HTTP status codes of responses which are retried, whether or not they carry errors.
+	Statuses []int
+	// Methods lists the HTTP methods which are idempotent, and so are safe to retry. Requests with other methods are
+	// retried only if they have an Idempotency-Key header.
+	Methods []string
+	// Budget limits the rate at which requests are retried. If it is nil, each RetryFilter has its own budget which
+	// allows up to 20% of requests to be retried, with a burst of up to 10 retries.
+	Budget *RetryBudget
+}
+
+// withDefaults returns a copy of the policy, with any unset fields populated from DefaultRetryPolicy.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	d := DefaultRetryPolicy
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = d.MaxAttempts
+	}
+	if p.BaseBackoff <= 0 {
+		p.BaseBackoff = d.BaseBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = d.MaxBackoff
+	}
+	if p.MaxRetryAfter <= 0 {
+		p.MaxRetryAfter = d.MaxRetryAfter
+	}
+	if p.Codes == nil {
+		p.Codes = d.Codes
+	}
+	if p.Statuses == nil {
+		p.Statuses = d.Statuses
+	}
+	if p.Methods == nil {
+		p.Methods = d.Methods
+	}
+	if p.Budget == nil {
+		p.Budget = d.Budget
+	}
+	if p.Budget == nil {
+		p.Budget = NewRetryBudget(0.2, 10)
+	}
+	return p
+}
+
+// idempotent reports whether a request is safe to retry.
+func (p RetryPolicy) idempotent(req Request) bool {
+	return slices.Contains(p.Methods, req.Method) || req.Header.Get("Idempotency-Key") != ""
+}
+
+// retryable reports whether a response indicates that its request may succeed if it is retried.
+func (p RetryPolicy) retryable(rsp Response) bool {
+	switch {
+	case rsp.Response == nil:
+		// The request failed without any response (eg. because a connection couldn't be established)
+		return rsp.Error != nil
+	case slices.Contains(p.Statuses, rsp.StatusCode):
+		return true
+	case rsp.Error == nil:
+		return false
+	case p.Codes == nil:
+		return terrors.IsRetryable(rsp.Error)
+	default:
+		return terrors.Is(rsp.Error, p.Codes...)
+	}
+}
+
+// backoff returns the delay before the given retry (counting from 1.)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	max := p.BaseBackoff
+	for i := 1; i < retry && max < p.MaxBackoff; i++ {
+		max *= 2
+	}
+	if max > p.MaxBackoff {
+		max = p.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// A RetryBudget is a token bucket which limits the rate of retries relative to the rate of requests, so retries
+// cannot amplify an outage. Each request deposits a fraction of a token, and each retry withdraws a whole token. It is
+// safe for concurrent use, and may be shared between several RetryFilters.
+type RetryBudget struct {
+	m      sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+// NewRetryBudget returns a RetryBudget which allows retries of up to ratio of requests (eg. 0.1 allows a retry for
+// every 10 requests), plus a burst of up to burst retries. The budget starts full.
+func NewRetryBudget(ratio float64, burst int) *RetryBudget {
+	return &RetryBudget{
+		ratio:  ratio,
+		max:    float64(burst),
+		tokens: float64(burst)}
+}
+
+func (b *RetryBudget) deposit() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryAfter returns the delay requested by a response's Retry-After header, if any.
+func retryAfter(rsp Response) (time.Duration, bool) {
+	if rsp.Response == nil {
+		return 0, false
+	}
+	v := rsp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil && secs >= 0 {
+		return time.Duration(min(secs, math.MaxInt64/int64(time.Second))) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// RetryFilter returns a Filter which retries requests that fail in a way the policy considers retryable, provided that
+// they are idempotent. It waits between attempts with exponential backoff, or for as long as a response's Retry-After
+// header requests (up to MaxRetryAfter); if the request's context would expire first, or a longer delay is requested,
+// the last response is returned instead. Requests whose context is cancelled aren't retried.
+//
+// Because each attempt must send the request's body again, only requests whose bodies are replayable are retried (see
+// Request.Replayable): those with streaming bodies are attempted once. Each attempt is made with a clone of the request.
+//
+// Applied directly to a transport like BareClient (and beneath ErrorFilter), the filter sees failures where no response
+// was received and retries them regardless of the policy's Codes. It can also be applied above ErrorFilter, in which
+// case such failures appear as internal_service errors.
+func RetryFilter(policy RetryPolicy) Filter {
+	p := policy.withDefaults()
+	return func(req Request, svc Service) Response {
+		p.Budget.deposit()
+		if !req.Replayable() || !p.idempotent(req) {
+			return svc(req)
+		}
+
+		var rsp Response
+		for attempt := 1; ; attempt++ {
+			rsp = svc(req.Clone(req.Context))
+			// Failures caused by the request's own cancellation aren't retried
+			if attempt >= p.MaxAttempts || req.Err() != nil || !p.retryable(rsp) {
+				return rsp
+			}
+
+			delay := p.backoff(attempt)
+			if d, ok := retryAfter(rsp); ok && d > delay {
+				if d > p.MaxRetryAfter {
+					return rsp
+				}
+				delay = d
+			}
+			if deadline, ok := req.Deadline(); ok && time.Until(deadline) < delay {
+				return rsp
+			}
+			if !p.Budget.withdraw() {
+				return rsp
+			}
+			if rsp.Response != nil && rsp.Body != nil {
+				rsp.Body.Close() // the response is discarded
+			}
+
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-req.Done():
+				t.Stop()
+				rsp = NewResponse(req)
+				rsp.Error = terrors.Timeout("retry_cancelled", "Request was cancelled while waiting to retry", nil)
+				return rsp
+			}
+		}
+	}
+}
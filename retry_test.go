@@ -0,0 +1,250 @@
+package typhon
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyService returns a Service which responds with each of the passed responses in turn (the last one repeatedly),
+// recording the bodies of the requests it receives.
+func flakyService(bodies *[]string, rsps ...func(Request) Response) Service {
+	var n int32
+	return func(req Request) Response {
+		i := int(atomic.AddInt32(&n, 1)) - 1
+		if i >= len(rsps) {
+			i = len(rsps) - 1
+		}
+		if bodies != nil {
+			b, _ := req.BodyBytes(true)
+			*bodies = append(*bodies, string(b))
+		}
+		return rsps[i](req)
+	}
+}
+
+func withStatus(code int) func(Request) Response {
+	return func(req Request) Response {
+		return NewResponseWithCode(req, code)
+	}
+}
+
+func withError(err error) func(Request) Response {
+	return func(req Request) Response {
+		rsp := NewResponse(req)
+		rsp.Error = err
+		return rsp
+	}
+}
+
+func withoutResponse(req Request) Response {
+	return Response{
+		Request: &req,
+		Error:   terrors.Wrap(io.ErrUnexpectedEOF, nil)}
+}
+
+func TestRetryFilter(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{
+		BaseBackoff: time.Millisecond,
+		MaxBackoff:  time.Millisecond}
+	ok := withStatus(http.StatusOK)
+
+	cases := []struct {
+		name     string
+		method   string
+		header   http.Header
+		rsps     []func(Request) Response
+		attempts int
+		status   int
+	}{
+		{"success", "GET", nil, []func(Request) Response{ok}, 1, http.StatusOK},
+		{"transport error", "GET", nil, []func(Request) Response{withoutResponse, ok}, 2, http.StatusOK},
+		{"unavailable", "PUT", nil, []func(Request) Response{withStatus(http.StatusServiceUnavailable), ok}, 2, http.StatusOK},
+		{"retryable terror", "DELETE", nil, []func(Request) Response{withError(terrors.Timeout("", "", nil)), ok}, 2, http.StatusOK},
+		{"non-retryable terror", "GET", nil, []func(Request) Response{withError(terrors.BadRequest("", "", nil)), ok}, 1, http.StatusOK},
+		{"non-retryable status", "GET", nil, []func(Request) Response{withStatus(http.StatusNotFound), ok}, 1, http.StatusNotFound},
+		{"non-idempotent", "POST", nil, []func(Request) Response{withoutResponse, ok}, 1, 0},
+		{"idempotency key", "POST", http.Header{"Idempotency-Key": {"abc"}}, []func(Request) Response{withoutResponse, ok}, 2, http.StatusOK},
+		{"max attempts", "GET", nil, []func(Request) Response{withStatus(http.StatusBadGateway)}, 3, http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			var bodies []string
+			svc := flakyService(&bodies, c.rsps...).Filter(RetryFilter(policy))
+			req := NewRequest(context.Background(), c.method, "/", map[string]string{"a": "b"})
+			for k, v := range c.header {
+				req.Header[k] = v
+			}
+			rsp := svc(req)
+			assert.Len(t, bodies, c.attempts)
+			for _, b := range bodies {
+				assert.Equal(t, `{"a":"b"}`+"\n", b)
+			}
+			if c.status == 0 {
+				assert.Nil(t, rsp.Response)
+				return
+			}
+			require.NotNil(t, rsp.Response)
+			assert.Equal(t, c.status, rsp.StatusCode)
+		})
+	}
+}
+
+func TestRetryFilterCodes(t *testing.T) {
+	t.Parallel()
+
+	var bodies []string
+	svc := flakyService(&bodies, withError(terrors.NotFound("", "", nil)), withStatus(http.StatusOK)).
+		Filter(RetryFilter(RetryPolicy{
+			BaseBackoff: time.Millisecond,
+			Codes:       []string{terrors.ErrNotFound}}))
+	rsp := svc(NewRequest(context.Background(), "GET", "/", nil))
+	require.NoError(t, rsp.Error)
+	assert.Len(t, bodies, 2)
+}
+
+func TestRetryFilterStreamingBody(t *testing.T) {
+	t.Parallel()
+
+	var bodies []string
+	svc := flakyService(&bodies, withoutResponse, withStatus(http.StatusOK)).Filter(RetryFilter(RetryPolicy{}))
+	req := NewRequest(context.Background(), "PUT", "/", io.NopCloser(strings.NewReader("streaming")))
+	rsp := svc(req)
+	assert.Error(t, rsp.Error)
+	assert.Equal(t, []string{"streaming"}, bodies)
+}
+
+func TestRetryFilterBudget(t *testing.T) {
+	t.Parallel()
+
+	budget := NewRetryBudget(0.5, 1)
+	var bodies []string
+	svc := flakyService(&bodies, withoutResponse).Filter(RetryFilter(RetryPolicy{
+		MaxAttempts: 5,
+		BaseBackoff: time.Millisecond,
+		Budget:      budget}))
+
+	// The first request can use the whole burst; the second deposits only half a token so can't retry
+	svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.Len(t, bodies, 2)
+	svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.Len(t, bodies, 3)
+	// The third request takes the budget back to one token
+	svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.Len(t, bodies, 5)
+}
+
+func TestRetryFilterRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	limited := func(req Request) Response {
+		rsp := NewResponseWithCode(req, http.StatusTooManyRequests)
+		rsp.Header.Set("Retry-After", "1")
+		return rsp
+	}
+	var bodies []string
+	svc := flakyService(&bodies, limited, withStatus(http.StatusOK)).Filter(RetryFilter(RetryPolicy{
+		BaseBackoff: time.Millisecond}))
+
+	// The request would expire before it could be retried, so the rate limited response is returned
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	rsp := svc(NewRequest(ctx, "GET", "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rsp.StatusCode)
+	assert.Len(t, bodies, 1)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// Without a deadline, the filter waits for as long as requested
+	bodies = nil
+	svc = flakyService(&bodies, limited, withStatus(http.StatusOK)).Filter(RetryFilter(RetryPolicy{
+		BaseBackoff: time.Millisecond}))
+	start = time.Now()
+	rsp = svc(NewRequest(context.Background(), "GET", "/", nil))
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Len(t, bodies, 2)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// Delays longer than MaxRetryAfter aren't waited for
+	for _, v := range []string{"86400", "99999999999999999", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)} {
+		bodies = nil
+		svc = flakyService(&bodies, func(req Request) Response {
+			rsp := NewResponseWithCode(req, http.StatusServiceUnavailable)
+			rsp.Header.Set("Retry-After", v)
+			return rsp
+		}, withStatus(http.StatusOK)).Filter(RetryFilter(RetryPolicy{
+			BaseBackoff:   time.Millisecond,
+			MaxRetryAfter: time.Minute}))
+		start = time.Now()
+		rsp = svc(NewRequest(context.Background(), "GET", "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode, v)
+		assert.Len(t, bodies, 1, v)
+		assert.Less(t, time.Since(start), 500*time.Millisecond, v)
+	}
+}
+
+func TestRetryFilterCancelled(t *testing.T) {
+	t.Parallel()
+
+	svc := flakyService(nil, withoutResponse).Filter(RetryFilter(RetryPolicy{
+		BaseBackoff: time.Second,
+		MaxBackoff:  time.Second}))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	rsp := svc(NewRequest(ctx, "GET", "/", nil))
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrTimeout))
+
+	// Requests which fail because they have been cancelled aren't retried, and don't use the budget
+	budget := NewRetryBudget(0, 1)
+	var bodies []string
+	svc = flakyService(&bodies, func(req Request) Response {
+		return Response{
+			Request: &req,
+			Error:   terrors.Wrap(req.Err(), nil)}
+	}).Filter(RetryFilter(RetryPolicy{
+		BaseBackoff: time.Millisecond,
+		Budget:      budget}))
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	rsp = svc(NewRequest(ctx, "GET", "/", nil))
+	require.Error(t, rsp.Error)
+	assert.Len(t, bodies, 1)
+	assert.True(t, budget.withdraw())
+}
+
+func TestRetryFilterE2E(t *testing.T) {
+	t.Parallel()
+
+	var n int32
+	svc := Service(func(req Request) Response {
+		if atomic.AddInt32(&n, 1) == 1 {
+			rsp := NewResponse(req)
+			rsp.Error = terrors.InternalService("flaky", "Try again", nil)
+			return rsp
+		}
+		return req.Response("ok")
+	}).Filter(ErrorFilter)
+	s, err := Listen(svc, "localhost:0")
+	require.NoError(t, err)
+	defer s.Stop(context.Background())
+
+	client := Service(BareClient).Filter(ErrorFilter).Filter(RetryFilter(RetryPolicy{
+		BaseBackoff: time.Millisecond}))
+	rsp := NewRequest(context.Background(), "PUT", "http://"+s.Listener().Addr().String(), "body").SendVia(client).Response()
+	require.NoError(t, rsp.Error)
+	var body string
+	require.NoError(t, rsp.Decode(&body))
+	assert.Equal(t, "ok", body)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&n))
+}
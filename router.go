@@ -2,8 +2,17 @@ package typhon
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/monzo/terrors"
@@ -12,87 +21,352 @@ import (
 // We use a custom type to guarantee we won't get a collision with another package. Using an anonymous struct type
 // directly means we'd get a collision with any other package that does the same.
 // https://play.golang.org/p/MxhRiL37R-9
-type routerContextKeyType struct{}
-type routerRequestPatternContextKeyType struct{}
-type routerRequestMethodContextKeyType struct{}
+type routerRouteInfoContextKeyType struct{}
+type routerMountContextKeyType struct{}
 
 var (
-	routerContextKey               = routerContextKeyType{}
-	routerRequestPatternContextKey = routerRequestPatternContextKeyType{}
-	routerRequestMethodContextKey  = routerRequestMethodContextKeyType{}
-	routerComponentsRe             = regexp.MustCompile(`(?:^|/)(\*\w*|:\w+)`)
+	routerRouteInfoContextKey = routerRouteInfoContextKeyType{}
+	routerMountContextKey     = routerMountContextKeyType{}
 )
 
 type routerEntry struct {
-	Method  string
-	Pattern string
-	Service Service
-	re      *regexp.Regexp
+	Method       string
+	Pattern      string
+	Host         string // the host pattern, if any (see Route.Host)
+	Service      Service
+	Name         string
+	segments     []routerSegment
+	hostSegments []routerSegment
+	predicates   []routerPredicate
+	named        bool // whether any of the segments (or host segments) capture a named parameter
+	seq          int
 }
 
 func (e routerEntry) String() string {
-	return fmt.Sprintf("%s %s", e.Method, e.Pattern)
+	s := fmt.Sprintf("%s %s%s", e.Method, e.Host, e.Pattern)
+	if len(e.predicates) > 0 {
+		descs := make([]string, len(e.predicates))
+		for i, p := range e.predicates {
+			descs[i] = p.String()
+		}
+		s += " [" + strings.Join(descs, ", ") + "]"
+	}
+	return s
+}
+
+// matches reports whether a request satisfies the route's host pattern and predicates. A route which has either never
+// matches a nil request.
+func (e *routerEntry) matches(req *Request) bool {
+	if e.hostSegments == nil && len(e.predicates) == 0 {
+		return true
+	}
+	if req == nil {
+		return false
+	}
+	if e.hostSegments != nil && !extract(e.hostSegments, requestHost(req), '.', 0, nil) {
+		return false
+	}
+	for _, p := range e.predicates {
+		if !p.match(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity is the number of conditions other than its method and path that a request must satisfy to match the
+// route. It decides precedence between routes whose paths are equally specific.
+func (e *routerEntry) specificity() int {
+	n := len(e.predicates)
+	if e.hostSegments != nil {
+		n++
+	}
+	return n
+}
+
+// conditions returns a sorted description of the route's host pattern and predicates, for comparison with others.
+func (e *routerEntry) conditions() []string {
+	var conditions []string
+	if e.hostSegments != nil {
+		keys := make([]string, len(e.hostSegments))
+		for i, s := range e.hostSegments {
+			keys[i] = s.key()
+		}
+		conditions = append(conditions, "host "+strings.Join(keys, "."))
+	}
+	for _, p := range e.predicates {
+		conditions = append(conditions, p.String())
+	}
+	sort.Strings(conditions)
+	return conditions
+}
+
+// A routerPredicate is a condition on a request's headers or query which it must satisfy to match a route.
+type routerPredicate struct {
+	header string         // the canonical name of a header which the request must have, or
+	query  string         // the name of a query parameter which the request must have
+	value  string         // for headers, the value which it must have (if re is nil)
+	re     *regexp.Regexp // for headers, an expression which its value must match
+}
+
+func (p routerPredicate) match(req *Request) bool {
+	if p.header == "" {
+		return req.URL.Query().Has(p.query)
+	}
+	for _, v := range req.Header.Values(p.header) {
+		if (p.re == nil && v == p.value) || (p.re != nil && p.re.MatchString(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p routerPredicate) String() string {
+	switch {
+	case p.header == "":
+		return "?" + p.query
+	case p.re != nil:
+		return fmt.Sprintf("%s ~ %s", p.header, p.re)
+	default:
+		return fmt.Sprintf("%s: %s", p.header, p.value)
+	}
+}
+
+// requestHost returns the host to which a request is addressed, normalised for matching against host patterns.
+func requestHost(req *Request) string {
+	host := req.Host
+	if host == "" && req.URL != nil {
+		host = req.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// A Route is a handle to a route registered with a Router.
+type Route struct {
+	entry *routerEntry
+	tree  *routerTree
+}
+
+// Method returns the method of the route, or "*" if it matches any method.
+func (rt Route) Method() string {
+	return rt.entry.Method
+}
+
+// Pattern returns the full pattern of the route, preceded by its host pattern (if any).
+func (rt Route) Pattern() string {
+	return rt.entry.Host + rt.entry.Pattern
+}
+
+// Name returns the name of the route, or an empty string if it has none.
+func (rt Route) Name() string {
+	return rt.entry.Name
+}
+
+// Named gives the route a name, by which it can be referred to when building URLs (see Router.URL). Names must be
+// unique within a Router (including its groups).
+func (rt Route) Named(name string) Route {
+	if other, ok := rt.tree.names[name]; ok && other != rt.entry {
+		panic(fmt.Errorf("route name %#v is already used by %v", name, other))
+	}
+	if rt.entry.Name != "" {
+		delete(rt.tree.names, rt.entry.Name)
+	}
+	if rt.tree.names == nil {
+		rt.tree.names = make(map[string]*routerEntry)
+	}
+	rt.entry.Name = name
+	rt.tree.names[name] = rt.entry
+	return rt
+}
+
+// Host restricts the route to requests for hosts which match pattern, like api.example.com or :tenant.example.com.
+// Host patterns are like path patterns, except that their components are delimited by dots. They are matched
+// case-insensitively against the host of the request, excluding any port. Parameters captured from the host are
+// available from Params alongside those captured from the path, which take precedence if their names clash.
+func (rt Route) Host(pattern string) Route {
+	if pattern == "" {
+		panic(fmt.Errorf("invalid host pattern %#v", pattern))
+	}
+	segments, err := compileSegments(pattern, '.')
+	if err != nil {
+		panic(fmt.Errorf("invalid host pattern %#v: %w", pattern, err))
+	}
+	for i, s := range segments {
+		if s.kind == staticSegment {
+			segments[i].text = strings.ToLower(s.text)
+		}
+		rt.entry.named = rt.entry.named || (s.kind != staticSegment && s.text != "")
+	}
+	rt.entry.Host, rt.entry.hostSegments = pattern, segments
+	return rt
+}
+
+// Header restricts the route to requests which have a header with the given name and value.
+func (rt Route) Header(name, value string) Route {
+	rt.entry.predicates = append(rt.entry.predicates, routerPredicate{
+		header: http.CanonicalHeaderKey(name),
+		value:  value})
+	return rt
+}
+
+// HeaderRegexp restricts the route to requests which have a header with the given name, whose value matches the
+// regular expression expr. Note that expr is not anchored, so it may match any part of the value.
+func (rt Route) HeaderRegexp(name, expr string) Route {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		panic(fmt.Errorf("invalid header expression %#v: %w", expr, err))
+	}
+	rt.entry.predicates = append(rt.entry.predicates, routerPredicate{
+		header: http.CanonicalHeaderKey(name),
+		re:     re})
+	return rt
+}
+
+// Query restricts the route to requests which have the named query parameter (with any value.)
+func (rt Route) Query(name string) Route {
+	rt.entry.predicates = append(rt.entry.predicates, routerPredicate{
+		query: name})
+	return rt
+}
+
+func (rt Route) String() string {
+	return rt.entry.String()
+}
+
+// MarshalJSON implements json.Marshaler.
+func (rt Route) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Method  string `json:"method"`
+		Pattern string `json:"pattern"`
+		Name    string `json:"name,omitempty"`
+	}{rt.Method(), rt.Pattern(), rt.Name()})
 }
 
+// PathCleaning determines how a Router treats requests whose paths aren't in their canonical form. A canonical path
+// has no empty, "." or ".." components, except that it may end with a slash. If no route matches the canonical form of
+// a path, the form with its trailing slash added or removed is used instead (if a route matches it); if neither matches,
+// the request isn't matched against the path as it was received, so it is not found.
+type PathCleaning int
+
+const (
+	// NoPathCleaning matches paths exactly as they are received.
+	NoPathCleaning PathCleaning = iota
+	// RedirectCleanPath redirects requests to the canonical form of their path, if a route matches it. GET and HEAD
+	// requests are redirected with 301 Moved Permanently; others with 308 Permanent Redirect, which preserves their
+	// method and body.
+	RedirectCleanPath
+	// RouteCleanPath dispatches requests as if they had the canonical form of their path, if a route matches it. The
+	// path of the request's URL is rewritten before it is passed to the route.
+	RouteCleanPath
+)
+
 // A Router multiplexes requests to a set of Services by pattern matching on method and path, and can also extract
 // parameters from paths.
 type Router struct {
-	entries []routerEntry
+	// LegacyPrecedence restores the behaviour of earlier versions of Typhon, where the route registered last takes
+	// precedence over all others that match a request, regardless of how specific they are.
+	LegacyPrecedence bool
+	// NotFound, if set, handles requests which don't match any route, in place of the default not_found error.
+	NotFound Service
+	// MethodNotAllowed, if set, handles requests which match the path of a route but not its method, in place of the
+	// default ErrMethodNotAllowed error. The acceptable methods are available from the request's RouteInfo, and they
+	// are listed in the Allow header of the response unless the Service sets it.
+	MethodNotAllowed Service
+	// PathCleaning determines how requests with paths that aren't in their canonical form are treated. By default, paths
+	// are matched exactly as they are received.
+	PathCleaning PathCleaning
+	tree         *routerTree
+	prefix       string   // prepended to patterns registered via this Router (see Group)
+	filters      []Filter // applied to Services registered via this Router, innermost first (see Group)
+}
+
+// routerMount describes the Mount through which a request has been dispatched to a Service.
+type routerMount struct {
+	pattern string            // the full pattern of the mount point, including those of any enclosing mounts
+	path    string            // the part of the original path which matched the mount point (and any enclosing mounts)
+	params  map[string]string // parameters captured by the mount point and any enclosing mounts
+}
+
+func routerMountForRequest(r Request) (routerMount, bool) {
+	m, ok := r.Context.Value(routerMountContextKey).(routerMount)
+	return m, ok
+}
+
+// RouteInfo describes how a Router dispatched a request. Routers attach it to the context of the requests they
+// dispatch, so it is available to the filters and Services of the route (see RouteInfoFromContext).
+type RouteInfo struct {
+	// Router is the Router which dispatched the request.
+	Router *Router
+	// Pattern is the pattern of the route which matched the request, including the pattern of any Mount beneath which
+	// the Router is served.
+	Pattern string
+	// Method is the method of the request.
+	Method string
+	// Params holds the path parameters captured for the request, including those captured by any Mount beneath which
+	// the Router is served. It is nil if there are none, and must not be modified.
+	Params map[string]string
+	// Allow holds the methods acceptable for the path of a request which was dispatched to the Router's
+	// MethodNotAllowed Service. It is nil otherwise.
+	Allow []string
+}
+
+// RouteInfoFromContext returns information about the route which dispatched the request, if available.
+func RouteInfoFromContext(ctx context.Context) (RouteInfo, bool) {
+	if info, ok := ctx.Value(routerRouteInfoContextKey).(*RouteInfo); ok {
+		return *info, true
+	}
+	return RouteInfo{}, false
 }
 
 // RouterForRequest returns a pointer to the Router that successfully dispatched the request, or nil.
 func RouterForRequest(r Request) *Router {
-	if v := r.Context.Value(routerContextKey); v != nil {
-		return v.(*Router)
-	}
-	return nil
+	info, _ := RouteInfoFromContext(r.Context)
+	return info.Router
 }
 
 func routerPathPatternForRequest(r Request) string {
-	if v := r.Context.Value(routerRequestPatternContextKey); v != nil {
-		return v.(string)
-	}
-	return ""
+	info, _ := RouteInfoFromContext(r.Context)
+	return info.Pattern
 }
 
 // RequestPatternFromContext returns the pattern that was matched for the request, if available.
 func RequestPatternFromContext(ctx context.Context) (string, bool) {
-	if v := ctx.Value(routerRequestPatternContextKey); v != nil {
-		return v.(string), true
-	}
-	return "", false
+	info, ok := RouteInfoFromContext(ctx)
+	return info.Pattern, ok
 }
 
 // RequestMethodFromContext returns the method of the request, if available.
 func RequestMethodFromContext(ctx context.Context) (string, bool) {
-	if v := ctx.Value(routerRequestMethodContextKey); v != nil {
-		return v.(string), true
-	}
-	return "", false
-}
-
-func (r *Router) compile(pattern string) *regexp.Regexp {
-	re, pos := ``, 0
-	for _, m := range routerComponentsRe.FindAllStringSubmatchIndex(pattern, -1) {
-		re += regexp.QuoteMeta(pattern[pos:m[2]]) // head
-		token := pattern[m[2]:m[3]]
-		switch sigil, name := token[0], token[1:]; sigil {
-		case '*':
-			if len(name) == 0 { // bare residual (*): doesn't capture what it consumes
-				re += `.*?`
-			} else { // named residual (*name): captures what it consumes
-				re += `(?P<` + name + `>.*?)`
-			}
-		case ':':
-			re += `(?P<` + name + `>[^/]+)`
-		default:
-			panic(fmt.Errorf("unhandled router token %#v", token))
-		}
-		pos = m[3]
+	info, ok := RouteInfoFromContext(ctx)
+	return info.Method, ok
+}
+
+// routeInfo returns the RouteInfo for a request, if it was dispatched by r.
+func (r Router) routeInfo(req Request) (RouteInfo, bool) {
+	info, ok := RouteInfoFromContext(req.Context)
+	if !ok || r.tree == nil || info.Router.tree != r.tree {
+		return RouteInfo{}, false
+	}
+	return info, true
+}
+
+// routes returns the Router's route table, creating it if necessary.
+func (r *Router) routes() *routerTree {
+	if r.tree == nil {
+		r.tree = &routerTree{}
 	}
-	re += regexp.QuoteMeta(pattern[pos:]) // tail
-	re = `^` + re + `$`
-	return regexp.MustCompile(re)
+	return r.tree
+}
+
+func (r *Router) compile(pattern string) []routerSegment {
+	segments, err := compileSegments(pattern, '/')
+	if err != nil {
+		panic(fmt.Errorf("invalid router pattern %#v: %w", pattern, err))
+	}
+	return segments
 }
 
 // Register associates a Service with a method and path.
@@ -103,119 +377,650 @@ func (r *Router) compile(pattern string) *regexp.Regexp {
 // As well as being literal paths, they can contain named parameters like :name whose value is dynamic and only known at
 // runtime, or *residual components which match (potentially) multiple path components.
 //
-// In the case that patterns are ambiguous, the last route to be registered will take precedence.
-func (r *Router) Register(method, pattern string, svc Service) {
-	re := r.compile(pattern)
-	r.entries = append(r.entries, routerEntry{
-		Method:  strings.ToUpper(method),
-		Pattern: pattern,
-		Service: svc,
-		re:      re})
-}
-
-// lookup is the internal version of Lookup, but it extracts path parameters into the passed map (and skips it if the
-// map is nil)
-func (r Router) lookup(method, path string, params map[string]string) (Service, string, bool) {
-	method = strings.ToUpper(method)
-	for i := len(r.entries) - 1; i >= 0; i-- { // iterate in reverse to prefer routes registered later
-		e := r.entries[i]
-		if (e.Method == method || e.Method == `*`) && e.re.MatchString(path) {
-			// We have a match
-			if params != nil && e.re.NumSubexp() > 0 { // extract params
-				names := e.re.SubexpNames()[1:]
-				for i, value := range e.re.FindStringSubmatch(path)[1:] {
-					params[names[i]] = value
-				}
+// Parameters can be constrained to match only certain values, by following their name with one of:
+//
+//	<int>     a base 10 integer, which fits in an int64 (see ParamInt)
+//	<uuid>    a UUID in its canonical, hyphenated form
+//	<re:...>  a regular expression, which must match the whole value
+//
+// A path which doesn't satisfy a constraint doesn't match the pattern, so it may be dispatched to another route.
+//
+// In the case that patterns are ambiguous, the most specific pattern takes precedence: working from left to right,
+// literal components are preferred to :parameters, which are in turn preferred to *residuals. Where patterns are
+// equally specific, the last route to be registered will take precedence. If LegacyPrecedence is set, the last route
+// to be registered always takes precedence.
+//
+// Routes can be further restricted to requests with particular hosts, headers or query parameters via the returned
+// Route (see Route.Host, Route.Header, Route.HeaderRegexp and Route.Query.) These conditions don't affect the
+// precedence of paths: they decide only between routes whose paths are equally specific, where the route with the most
+// conditions takes precedence. Requests which don't satisfy a route's conditions are dispatched as if it didn't exist.
+//
+// Any filters passed are applied to svc in order, as if by svc.Filter(filters[0]).Filter(filters[1])..., so the last
+// filter is outermost. They are applied after routing has taken place, so they can inspect the matched pattern and
+// parameters via RequestPatternFromContext and Params.
+//
+// The returned Route can also be used to name the route, like:
+//
+//	r.Register("GET", "/users/:id", svc).Named("user")
+func (r *Router) Register(method, pattern string, svc Service, filters ...Filter) Route {
+	pattern = r.prefix + pattern
+	e := &routerEntry{
+		Method:   strings.ToUpper(method),
+		Pattern:  pattern,
+		Service:  r.filter(svc, filters),
+		segments: r.compile(pattern)}
+	r.routes().insert(e)
+	return Route{
+		entry: e,
+		tree:  r.tree}
+}
+
+// Group returns a Router which registers routes into the same route table as r, with prefix prepended to their
+// patterns. For example, this registers a route with the pattern /admin/users/:id:
+//
+//	admin := r.Group("/admin")
+//	admin.GET("/users/:id", svc)
+//
+// Any filters passed are applied to each Service registered via the group, outside any filters specific to the route
+// and inside those of any enclosing group. Because the route table is shared, serving either Router dispatches to the
+// routes registered via both.
+func (r *Router) Group(prefix string, filters ...Filter) *Router {
+	return &Router{
+		LegacyPrecedence: r.LegacyPrecedence,
+		NotFound:         r.NotFound,
+		MethodNotAllowed: r.MethodNotAllowed,
+		PathCleaning:     r.PathCleaning,
+		tree:             r.routes(),
+		prefix:           r.prefix + strings.TrimSuffix(prefix, "/"),
+		filters:          append(append([]Filter(nil), filters...), r.filters...)}
+}
+
+// filter wraps svc in the passed route-specific filters, followed by those of the Router.
+func (r *Router) filter(svc Service, filters []Filter) Service {
+	for _, f := range filters {
+		svc = svc.Filter(f)
+	}
+	for _, f := range r.filters {
+		svc = svc.Filter(f)
+	}
+	return svc
+}
+
+// Mount delegates requests for prefix, and for any path beneath it, to svc regardless of their method. The prefix is
+// stripped from the request's path before it is passed to svc, so a Router served by svc should register patterns
+// relative to the mount point:
+//
+//	users := typhon.Router{}
+//	users.GET("/:id", svc)
+//	r.Mount("/users", users.Serve())
+//
+// The prefix may contain :parameters, but not *residuals. A Router served beneath a mount point reports the full
+// pattern (eg. /users/:id) from RequestPatternFromContext, and its Params include those captured by the prefix.
+//
+// Any filters passed are applied as they are by Register, and so see the request before the prefix is stripped.
+func (r *Router) Mount(prefix string, svc Service, filters ...Filter) {
+	prefix = r.prefix + strings.TrimSuffix(prefix, "/")
+	segments := r.compile(prefix)
+	for _, s := range segments {
+		if s.kind == residualSegment {
+			panic(fmt.Errorf("mount prefix %#v cannot contain residuals", prefix))
+		}
+	}
+
+	mounted := func(req Request) Response {
+		// Each segment of the prefix consumes exactly one component of the path; find where the remainder begins
+		path, pos := req.URL.Path, 0
+		for range segments {
+			pos = nextComponent(path, pos, '/') + 1
+		}
+		m := routerMount{
+			pattern: prefix,
+			path:    path[:pos-1],
+			params:  map[string]string{}}
+		if parent, ok := routerMountForRequest(req); ok {
+			m.pattern = parent.pattern + prefix
+			m.path = parent.path + m.path
+			for k, v := range parent.params {
+				m.params[k] = v
 			}
-			return e.Service, e.Pattern, true
 		}
+		extract(segments, path[:pos-1], '/', 0, m.params)
+
+		u := *req.URL
+		u.Path, u.RawPath = "/", ""
+		if pos <= len(path) {
+			u.Path = path[pos-1:]
+		}
+		req.URL = &u
+		req.Context = context.WithValue(req.Context, routerMountContextKey, m)
+		return svc(req)
+	}
+	mounted = r.filter(mounted, filters)
+	r.routes().insert(&routerEntry{
+		Method:   "*",
+		Pattern:  prefix,
+		Service:  mounted,
+		segments: segments})
+	r.tree.insert(&routerEntry{
+		Method:   "*",
+		Pattern:  prefix + "/*",
+		Service:  mounted,
+		segments: r.compile(prefix + "/*")})
+}
+
+// match finds the route for the HTTP method and path. Routes with host patterns or predicates are considered only if
+// req is non-nil.
+func (r Router) match(method, path string, req *Request) routerMatcher {
+	m := routerMatcher{
+		method: strings.ToUpper(method),
+		path:   path,
+		req:    req,
+		legacy: r.LegacyPrecedence}
+	if r.tree != nil {
+		m.match(&r.tree.root, 0)
+	}
+	return m
+}
+
+// lookup is the internal version of Lookup, but it considers routes with host patterns and predicates if req is
+// non-nil, and it extracts parameters into the passed map (and skips it if the map is nil)
+func (r Router) lookup(method, path string, req *Request, params map[string]string) *routerEntry {
+	m := r.match(method, path, req)
+	if m.entry == nil {
+		return nil
+	}
+	if params != nil {
+		if m.entry.hostSegments != nil {
+			extract(m.entry.hostSegments, requestHost(req), '.', 0, params)
+		}
+		extract(m.entry.segments, path, '/', 0, params)
 	}
-	return nil, "", false
+	return m.entry
 }
 
-// Lookup returns the Service, pattern, and extracted path parameters for the HTTP method and path.
+// Lookup returns the Service, pattern, and extracted path parameters for the HTTP method and path. Because it has no
+// request to examine, it never returns routes with host patterns or predicates.
 func (r Router) Lookup(method, path string) (Service, string, map[string]string, bool) {
 	params := map[string]string{}
-	svc, pattern, ok := r.lookup(method, path, params)
-	return svc, pattern, params, ok
+	if e := r.lookup(method, path, nil, params); e != nil {
+		return e.Service, e.Pattern, params, true
+	}
+	return nil, "", params, false
 }
 
 // Serve returns a Service which will route inbound requests to the enclosed routes.
+//
+// If no route matches the request's path, the Service responds with a not_found error. If routes match the path but
+// not the method, it responds with an ErrMethodNotAllowed error and an Allow header listing the acceptable methods;
+// OPTIONS requests for such paths are answered automatically in the same way, but without an error. These responses
+// can be customised by setting NotFound and MethodNotAllowed; the requests passed to them have a RouteInfo without a
+// Pattern.
+//
+// If PathCleaning is set, requests whose paths aren't in their canonical form are redirected or rewritten before they
+// are dispatched, so the canonical pattern is reported to filters.
+//
+// HEAD requests which don't match a route are dispatched to the matching GET route (if any), and the body of its
+// response is discarded.
+//
+// The Service routes requests to the routes registered before Serve is called: routes registered afterwards (including
+// via a Group) aren't visible to it, so they may be registered while it is serving requests.
 func (r Router) Serve() Service {
+	// Requests are matched against a snapshot of the routes, but the RouteInfo of those dispatched refers to the Router
+	// itself
+	snapshot := r
+	snapshot.tree = r.tree.snapshot()
 	return func(req Request) Response {
-		svc, pathPattern, ok := r.lookup(req.Method, req.URL.Path, nil)
-		if !ok {
-			txt := fmt.Sprintf("No handler for %s %s", req.Method, req.URL.Path)
-			rsp := NewResponse(req)
-			rsp.Error = terrors.NotFound("no_handler", txt, nil)
-			return rsp
+		var m routerMatcher
+		if r.PathCleaning == NoPathCleaning {
+			m = snapshot.match(req.Method, req.URL.Path, &req)
+		} else {
+			var path string
+			path, m = snapshot.canonical(req.Method, req.URL.Path, &req)
+			if m.entry == nil && len(m.allow) == 0 {
+				// If no route matches the path for any method, a GET route can't match it for a HEAD request either
+				return r.unmatched(req, nil)
+			}
+			if path != req.URL.Path {
+				if r.PathCleaning == RedirectCleanPath {
+					return r.redirect(req, path)
+				}
+				u := *req.URL
+				u.Path, u.RawPath = path, ""
+				req.URL = &u
+			}
+		}
+		head := false
+		if m.entry == nil && m.method == http.MethodHead {
+			if get := snapshot.match(http.MethodGet, req.URL.Path, &req); get.entry != nil {
+				m, head = get, true
+			}
 		}
-		req.Context = context.WithValue(req.Context, routerContextKey, &r)
-		req.Context = context.WithValue(req.Context, routerRequestPatternContextKey, pathPattern)
-		req.Context = context.WithValue(req.Context, routerRequestMethodContextKey, req.Method)
-		rsp := svc(req)
-		if rsp.Request == nil {
-			rsp.Request = &req
+		if m.entry == nil {
+			return r.unmatched(req, m.allow)
+		}
+
+		info := &RouteInfo{
+			Router:  &r,
+			Pattern: m.entry.Pattern,
+			Method:  req.Method}
+		mount, mounted := routerMountForRequest(req)
+		if mounted {
+			info.Pattern = mount.pattern + info.Pattern
+		}
+		info.Pattern = m.entry.Host + info.Pattern
+		if mounted || m.entry.named {
+			info.Params = make(map[string]string, len(mount.params)+len(m.entry.hostSegments)+len(m.entry.segments))
+			for k, v := range mount.params {
+				info.Params[k] = v
+			}
+			if m.entry.hostSegments != nil {
+				extract(m.entry.hostSegments, requestHost(&req), '.', 0, info.Params)
+			}
+			extract(m.entry.segments, req.URL.Path, '/', 0, info.Params)
+		}
+		rsp := r.dispatch(req, info, m.entry.Service)
+		if head && rsp.Response != nil && rsp.Body != nil {
+			rsp.Body.Close()
+			rsp.Body = &bufCloser{}
 		}
 		return rsp
 	}
 }
 
-// Pattern returns the registered pattern which matches the given request.
+// canonical finds the canonical form of a request's path which matches a route, along with the result of matching it.
+// If no form matches, it returns the path as it is, and a matcher which hasn't matched any route.
+func (r Router) canonical(method, p string, req *Request) (string, routerMatcher) {
+	matched := func(m routerMatcher) bool {
+		return m.entry != nil || len(m.allow) > 0
+	}
+	clean := cleanPath(p)
+	m := r.match(method, clean, req)
+	if matched(m) {
+		return clean, m
+	}
+	if clean != "/" {
+		alt := clean + "/"
+		if strings.HasSuffix(clean, "/") {
+			alt = clean[:len(clean)-1]
+		}
+		if am := r.match(method, alt, req); matched(am) {
+			return alt, am
+		}
+	}
+	// The path as it is isn't matched: its "." and ".." components mustn't reach routes literally
+	return p, routerMatcher{method: m.method}
+}
+
+// cleanPath returns the canonical form of a path: with "." and ".." components resolved, and empty components removed
+// except for a trailing slash.
+func cleanPath(p string) string {
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	clean := path.Clean(p)
+	if p[len(p)-1] == '/' && clean != "/" {
+		if len(p) == len(clean)+1 && strings.HasPrefix(p, clean) {
+			return p // avoid allocating a copy of p
+		}
+		clean += "/"
+	}
+	return clean
+}
+
+// redirect responds to a request with a redirect to path, preserving its query. If the Router is served beneath a
+// Mount, path is relative to the mount point.
+func (r Router) redirect(req Request, path string) Response {
+	code := http.StatusPermanentRedirect
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		code = http.StatusMovedPermanently
+	}
+	if m, mounted := routerMountForRequest(req); mounted {
+		path = m.path + path
+	}
+	u := url.URL{
+		Path:     path,
+		RawQuery: req.URL.RawQuery}
+	rsp := NewResponseWithCode(req, code)
+	rsp.Header.Set("Location", u.String())
+	return rsp
+}
+
+// unmatched produces the response to a request which didn't match any route. allow holds the methods of the routes
+// which matched its path, if any.
+func (r Router) unmatched(req Request, allow []string) Response {
+	if len(allow) == 0 {
+		if r.NotFound != nil {
+			return r.dispatch(req, r.unmatchedInfo(req, nil), r.NotFound)
+		}
+		txt := fmt.Sprintf("No handler for %s %s", req.Method, req.URL.Path)
+		rsp := NewResponse(req)
+		rsp.Error = terrors.NotFound("no_handler", txt, nil)
+		return rsp
+	}
+
+	methods := map[string]bool{http.MethodOptions: true}
+	for _, method := range allow {
+		methods[method] = true
+		if method == http.MethodGet {
+			methods[http.MethodHead] = true
+		}
+	}
+	allow = allow[:0]
+	for method := range methods {
+		allow = append(allow, method)
+	}
+	sort.Strings(allow)
+
+	var rsp Response
+	switch {
+	case req.Method == http.MethodOptions:
+		rsp = NewResponseWithCode(req, http.StatusNoContent)
+	case r.MethodNotAllowed != nil:
+		rsp = r.dispatch(req, r.unmatchedInfo(req, allow), r.MethodNotAllowed)
+		if rsp.Response == nil || rsp.Header.Get("Allow") != "" {
+			return rsp
+		}
+	default:
+		txt := fmt.Sprintf("Method %s not allowed for %s", req.Method, req.URL.Path)
+		rsp = NewResponse(req)
+		rsp.Error = terrors.New(ErrMethodNotAllowed, txt, nil)
+	}
+	if rsp.Header == nil {
+		rsp.Header = http.Header{}
+	}
+	rsp.Header.Set("Allow", strings.Join(allow, ", "))
+	return rsp
+}
+
+// unmatchedInfo returns the RouteInfo for a request which didn't match any route.
+func (r Router) unmatchedInfo(req Request, allow []string) *RouteInfo {
+	info := &RouteInfo{
+		Router: &r,
+		Method: req.Method,
+		Allow:  allow}
+	if mount, mounted := routerMountForRequest(req); mounted {
+		info.Params = mount.params
+	}
+	return info
+}
+
+// dispatch passes a request to svc, with info attached to its context.
+func (r Router) dispatch(req Request, info *RouteInfo, svc Service) Response {
+	req.Context = context.WithValue(req.Context, routerRouteInfoContextKey, info)
+	rsp := svc(req)
+	if rsp.Request == nil {
+		rsp.Request = &req
+	}
+	return rsp
+}
+
+// Pattern returns the registered pattern which matches the given request. If the Router is served beneath a mount
+// point, the pattern includes that of the mount point. If the route has a host pattern, it precedes the path.
 func (r Router) Pattern(req Request) string {
-	_, pattern, _ := r.lookup(req.Method, req.URL.Path, nil)
-	return pattern
+	if info, ok := r.routeInfo(req); ok {
+		return info.Pattern
+	}
+	e := r.lookup(req.Method, req.URL.Path, &req, nil)
+	if e == nil {
+		return ""
+	}
+	pattern := e.Pattern
+	if m, mounted := routerMountForRequest(req); mounted {
+		pattern = m.pattern + pattern
+	}
+	return e.Host + pattern
 }
 
-// Params returns extracted path parameters, assuming the request has been routed and has captured parameters.
+// Params returns extracted path parameters, assuming the request has been routed and has captured parameters. If the
+// Router is served beneath a mount point, parameters captured by the mount point are included.
+//
+// If the request was dispatched by the Router, the parameters it captured are copied from the request's RouteInfo.
+// Otherwise, they are found by looking up the request's route again.
 func (r Router) Params(req Request) map[string]string {
-	_, _, params, _ := r.Lookup(req.Method, req.URL.Path)
+	params := map[string]string{}
+	if info, ok := r.routeInfo(req); ok {
+		for k, v := range info.Params {
+			params[k] = v
+		}
+		return params
+	}
+	if m, mounted := routerMountForRequest(req); mounted {
+		for k, v := range m.params {
+			params[k] = v
+		}
+	}
+	r.lookup(req.Method, req.URL.Path, &req, params)
 	return params
 }
 
+// Param returns the value of the named path parameter of a request which has been dispatched by a Router.
+func Param(req Request, name string) (string, bool) {
+	info, _ := RouteInfoFromContext(req.Context)
+	v, ok := info.Params[name]
+	return v, ok
+}
+
+// ParamInt returns the value of the named path parameter of a request which has been dispatched by a Router, parsed as
+// a base 10 integer. It is most useful for parameters with an <int> constraint.
+func ParamInt(req Request, name string) (int64, error) {
+	v, ok := Param(req, name)
+	if !ok {
+		return 0, terrors.InternalService("missing_param", fmt.Sprintf("No path parameter %#v", name), nil)
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, terrors.BadRequest("bad_param", fmt.Sprintf("Path parameter %#v is not an integer", name), map[string]string{
+			name: v})
+	}
+	return i, nil
+}
+
+// URL builds a URL whose path would match the named route, by substituting the passed values for the parameters and
+// residuals in its pattern. Parameters must have non-empty values which don't contain a slash and which satisfy any
+// constraint; residuals may have any value. An error is returned if the route doesn't exist, or if a value is missing
+// or doesn't match.
+//
+// Only the path of the URL is populated, so it may be resolved relative to the base URL of a service. If the Router is
+// served beneath a Mount, the path is relative to the mount point. If the route has a host pattern, the host of the
+// URL is populated too, and parameters within it must not contain a dot.
+func (r Router) URL(name string, params map[string]string) (*url.URL, error) {
+	var e *routerEntry
+	if r.tree != nil {
+		e = r.tree.names[name]
+	}
+	if e == nil {
+		return nil, terrors.InternalService("unknown_route", fmt.Sprintf("No route named %#v", name), nil)
+	}
+
+	u := &url.URL{}
+	var err error
+	if e.hostSegments != nil {
+		if u.Host, err = render(name, e.hostSegments, '.', params); err != nil {
+			return nil, err
+		}
+	}
+	if u.Path, err = render(name, e.segments, '/', params); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// render substitutes values for the parameters and residuals within the segments of the named route, and joins them
+// with sep.
+func render(name string, segments []routerSegment, sep byte, params map[string]string) (string, error) {
+	components := make([]string, len(segments))
+	for i, s := range segments {
+		if s.kind == staticSegment {
+			components[i] = s.text
+			continue
+		}
+		v, ok := params[s.text]
+		if !ok && s.text != "" {
+			return "", terrors.InternalService("missing_param", fmt.Sprintf("No value for parameter %#v of route %#v", s.text, name), nil)
+		}
+		if _, match := s.capture(v + s.suffix); !match || (s.kind == paramSegment && strings.IndexByte(v, sep) >= 0) {
+			return "", terrors.BadRequest("bad_param", fmt.Sprintf("Value for parameter %#v of route %#v doesn't match", s.text, name), map[string]string{
+				s.text: v})
+		}
+		components[i] = v + s.suffix
+	}
+	return strings.Join(components, string(sep)), nil
+}
+
+// Path is like URL, but returns only the (escaped) path.
+func (r Router) Path(name string, params map[string]string) (string, error) {
+	u, err := r.URL(name, params)
+	if err != nil {
+		return "", err
+	}
+	return u.EscapedPath(), nil
+}
+
+// Routes returns the routes registered with the Router (including its groups), in order of registration. Each Mount
+// is represented by two routes: one for the mount point itself, and one for the paths beneath it.
+func (r Router) Routes() []Route {
+	if r.tree == nil {
+		return nil
+	}
+	routes := make([]Route, len(r.tree.entries))
+	for i, e := range r.tree.entries {
+		routes[i] = Route{
+			entry: e,
+			tree:  r.tree}
+	}
+	return routes
+}
+
+// Validate checks the Router's routes for mistakes, returning an error describing each route which can never be
+// reached because it is shadowed by another, and each pair of routes whose precedence is ambiguous (ie. decided only
+// by the order of their registration.) It returns nil if no problems are found.
+//
+// Validate is conservative: it only reports problems it is certain of, except for ambiguity between parameters with
+// regular expression constraints, which are reported if they could possibly overlap.
+func (r Router) Validate() error {
+	return errors.Join(r.validate()...)
+}
+
+func (r Router) validate() []error {
+	if r.tree == nil {
+		return nil
+	}
+	var errs []error
+	entries := r.tree.entries
+	for i, a := range entries {
+		for _, b := range entries[i+1:] {
+			if b.Method != a.Method && b.Method != "*" {
+				continue
+			}
+			// A route is shadowed by a later one which matches all the same paths, and whose conditions are the same
+			// (or, with legacy precedence, are satisfied by all the same requests)
+			if !sameShape(a.segments, b.segments) && !(r.LegacyPrecedence && covers(b.segments, a.segments)) {
+				continue
+			}
+			ca, cb := a.conditions(), b.conditions()
+			if slices.Equal(ca, cb) || (r.LegacyPrecedence && subset(cb, ca)) {
+				errs = append(errs, fmt.Errorf("route %v is shadowed by %v", a, b))
+				break
+			}
+		}
+		if r.LegacyPrecedence {
+			continue
+		}
+		for _, b := range entries[i+1:] {
+			if a.Method != b.Method && a.Method != "*" && b.Method != "*" {
+				continue
+			}
+			if slices.Equal(a.conditions(), b.conditions()) {
+				if ambiguous(a.segments, b.segments) {
+					errs = append(errs, fmt.Errorf("routes %v and %v are ambiguous", a, b))
+				}
+			} else if sameShape(a.segments, b.segments) && a.specificity() == b.specificity() && !disjoint(a, b) {
+				errs = append(errs, fmt.Errorf("routes %v and %v are ambiguous", a, b))
+			}
+		}
+	}
+	return errs
+}
+
+// RouteTableService returns a Service which describes the Router's routes as JSON, along with any problems reported
+// by Validate. It is intended to aid debugging.
+func (r Router) RouteTableService() Service {
+	return func(req Request) Response {
+		problems := []string{}
+		for _, err := range r.validate() {
+			problems = append(problems, err.Error())
+		}
+		routes := r.Routes()
+		if routes == nil {
+			routes = []Route{}
+		}
+		return req.Response(map[string]interface{}{
+			"routes":   routes,
+			"problems": problems})
+	}
+}
+
 // Sugar
 
 // GET is shorthand for:
 //
-//	r.Register("GET", pattern, svc)
-func (r *Router) GET(pattern string, svc Service) { r.Register("GET", pattern, svc) }
+//	r.Register("GET", pattern, svc, filters...)
+func (r *Router) GET(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("GET", pattern, svc, filters...)
+}
 
 // CONNECT is shorthand for:
 //
-//	r.Register("CONNECT", pattern, svc)
-func (r *Router) CONNECT(pattern string, svc Service) { r.Register("CONNECT", pattern, svc) }
+//	r.Register("CONNECT", pattern, svc, filters...)
+func (r *Router) CONNECT(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("CONNECT", pattern, svc, filters...)
+}
 
 // DELETE is shorthand for:
 //
-//	r.Register("DELETE", pattern, svc)
-func (r *Router) DELETE(pattern string, svc Service) { r.Register("DELETE", pattern, svc) }
+//	r.Register("DELETE", pattern, svc, filters...)
+func (r *Router) DELETE(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("DELETE", pattern, svc, filters...)
+}
 
 // HEAD is shorthand for:
 //
-//	r.Register("HEAD", pattern, svc)
-func (r *Router) HEAD(pattern string, svc Service) { r.Register("HEAD", pattern, svc) }
+//	r.Register("HEAD", pattern, svc, filters...)
+func (r *Router) HEAD(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("HEAD", pattern, svc, filters...)
+}
 
 // OPTIONS is shorthand for:
 //
-//	r.Register("OPTIONS", pattern, svc)
-func (r *Router) OPTIONS(pattern string, svc Service) { r.Register("OPTIONS", pattern, svc) }
+//	r.Register("OPTIONS", pattern, svc, filters...)
+func (r *Router) OPTIONS(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("OPTIONS", pattern, svc, filters...)
+}
 
 // PATCH is shorthand for:
 //
-//	r.Register("PATCH", pattern, svc)
-func (r *Router) PATCH(pattern string, svc Service) { r.Register("PATCH", pattern, svc) }
+//	r.Register("PATCH", pattern, svc, filters...)
+func (r *Router) PATCH(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("PATCH", pattern, svc, filters...)
+}
 
 // POST is shorthand for:
 //
-//	r.Register("POST", pattern, svc)
-func (r *Router) POST(pattern string, svc Service) { r.Register("POST", pattern, svc) }
+//	r.Register("POST", pattern, svc, filters...)
+func (r *Router) POST(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("POST", pattern, svc, filters...)
+}
 
 // PUT is shorthand for:
 //
-//	r.Register("PUT", pattern, svc)
-func (r *Router) PUT(pattern string, svc Service) { r.Register("PUT", pattern, svc) }
+//	r.Register("PUT", pattern, svc, filters...)
+func (r *Router) PUT(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("PUT", pattern, svc, filters...)
+}
 
 // TRACE is shorthand for:
 //
-//	r.Register("TRACE", pattern, svc)
-func (r *Router) TRACE(pattern string, svc Service) { r.Register("TRACE", pattern, svc) }
+//	r.Register("TRACE", pattern, svc, filters...)
+func (r *Router) TRACE(pattern string, svc Service, filters ...Filter) Route {
+	return r.Register("TRACE", pattern, svc, filters...)
+}
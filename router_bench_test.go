@@ -33,3 +33,25 @@ func BenchmarkRouter(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkRouterManyRoutes(b *testing.B) {
+	svc := func(req Request) Response {
+		return Response{}
+	}
+	router := Router{}
+	for i := 0; i < 100; i++ {
+		router.GET(fmt.Sprintf("/resource%d", i), svc)
+		router.GET(fmt.Sprintf("/resource%d/:id", i), svc)
+		router.PUT(fmt.Sprintf("/resource%d/:id", i), svc)
+		router.GET(fmt.Sprintf("/resource%d/:id/*rest", i), svc)
+	}
+
+	for _, path := range []string{"/resource0", "/resource99/123", "/resource50/123/a/b/c", "/404"} {
+		b.Run(path, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				router.lookup("GET", path, nil, nil)
+			}
+		})
+	}
+}
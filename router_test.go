@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/monzo/terrors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -110,6 +111,38 @@ func TestRouterForRequest(t *testing.T) {
 	assert.Equal(t, router, *reqRouter)
 }
 
+func TestRouterServeSnapshotsRoutes(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	// Routes registered after Serve aren't visible to the Service it returns, whether or not any were registered before
+	empty := Router{}
+	emptySvc := empty.Serve()
+	empty.GET("/later", svc)
+
+	router := Router{}
+	router.GET("/before", svc)
+	group := router.Group("/group")
+	routerSvc := router.Serve()
+	router.GET("/later", svc)
+	group.GET("/later", svc)
+
+	for path, svc := range map[string]Service{
+		"/later":       emptySvc,
+		"/group/later": routerSvc} {
+		rsp := svc(NewRequest(context.Background(), "GET", path, nil))
+		assert.True(t, terrors.Is(rsp.Error, terrors.ErrNotFound), path)
+	}
+	rsp := routerSvc(NewRequest(context.Background(), "GET", "/later", nil))
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrNotFound))
+	rsp = routerSvc(NewRequest(context.Background(), "GET", "/before", nil))
+	assert.NoError(t, rsp.Error)
+	rsp = router.Serve()(NewRequest(context.Background(), "GET", "/group/later", nil))
+	assert.NoError(t, rsp.Error)
+}
+
 func TestRouterSetsRequest(t *testing.T) {
 	t.Parallel()
 
@@ -148,3 +181,915 @@ func TestRouterSetsContextValues(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, "GET", ctxMethod)
 }
+
+func TestRouterPrecedence(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	// Registered from most to least specific, which would be the wrong order under legacy precedence
+	router.GET("/users/me", svc)
+	router.GET("/users/me/settings", svc)
+	router.GET("/users/:id", svc)
+	router.GET("/users/:id/avatar", svc)
+	router.GET("/users/:id/*rest", svc)
+	router.GET("/files/:name.json", svc)
+	router.GET("/files/:name", svc)
+	router.GET("/*rest", svc)
+	// Equally specific, so the one registered last takes precedence
+	router.GET("/m/:id<int>", svc)
+	router.GET("/m/:n<re:[0-9]+>", svc)
+	router.GET("/a/:x<re:[a-z]+>", svc)
+	router.GET("/a/:y<re:[a-c]+>", svc)
+	router.GET("/a/:x<re:[a-z]+>", svc)
+	router.GET("/r/:id/*a", svc)
+	router.GET("/r/:id/*b.json", svc)
+	router.GET("/r/:id/*c.json", svc)
+
+	cases := []struct {
+		path    string
+		pattern string
+		params  map[string]string
+	}{
+		{"/users/me", "/users/me", map[string]string{}},
+		{"/users/me/settings", "/users/me/settings", map[string]string{}},
+		{"/users/123", "/users/:id", map[string]string{"id": "123"}},
+		// the literal "me" matches, but nothing registered beneath it does; the search backtracks to :id
+		{"/users/me/avatar", "/users/:id/avatar", map[string]string{"id": "me"}},
+		{"/users/me/friends", "/users/:id/*rest", map[string]string{"id": "me", "rest": "friends"}},
+		{"/files/a.json", "/files/:name.json", map[string]string{"name": "a"}},
+		{"/files/.json", "/files/:name", map[string]string{"name": ".json"}},
+		{"/files/a.txt", "/files/:name", map[string]string{"name": "a.txt"}},
+		{"/users", "/*rest", map[string]string{"rest": "users"}},
+		{"/something/else", "/*rest", map[string]string{"rest": "something/else"}},
+		{"/m/5", "/m/:n<re:[0-9]+>", map[string]string{"n": "5"}},
+		{"/a/abc", "/a/:x<re:[a-z]+>", map[string]string{"x": "abc"}},
+		{"/r/1/x.json", "/r/:id/*c.json", map[string]string{"id": "1", "c": "x"}},
+		{"/r/1/x.txt", "/r/:id/*a", map[string]string{"id": "1", "a": "x.txt"}},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			_, pattern, params, ok := router.Lookup("GET", c.path)
+			require.True(t, ok)
+			assert.Equal(t, c.pattern, pattern)
+			assert.Equal(t, c.params, params)
+		})
+	}
+}
+
+func TestRouterMethodBacktracking(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	router.GET("/users/me", svc)
+	router.POST("/users/:id", svc)
+
+	// The literal route only accepts GET, so a POST should fall through to the parameterised route
+	_, pattern, params, ok := router.Lookup("POST", "/users/me")
+	require.True(t, ok)
+	assert.Equal(t, "/users/:id", pattern)
+	assert.Equal(t, map[string]string{"id": "me"}, params)
+
+	_, _, _, ok = router.Lookup("DELETE", "/users/me")
+	assert.False(t, ok)
+}
+
+func TestRouterLegacyPrecedence(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{LegacyPrecedence: true}
+	router.GET("/users/me", svc)
+	router.GET("/users/:id", svc)
+	router.GET("/users/:id/*rest", svc)
+	router.GET("/users/me/settings", svc)
+
+	cases := []struct {
+		path    string
+		pattern string
+	}{
+		{"/users/me", "/users/:id"},
+		{"/users/123", "/users/:id"},
+		{"/users/me/settings", "/users/me/settings"},
+		{"/users/me/friends", "/users/:id/*rest"},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			_, pattern, _, ok := router.Lookup("GET", c.path)
+			require.True(t, ok)
+			assert.Equal(t, c.pattern, pattern)
+		})
+	}
+
+	// The test harness is insensitive to the precedence mode
+	legacy, cases2 := routerTestHarness()
+	legacy.LegacyPrecedence = true
+	for _, c := range cases2 {
+		_, pattern, params, ok := legacy.Lookup(c.method, c.path)
+		assert.Equal(t, c.status == http.StatusOK, ok, "%s %s", c.method, c.path)
+		assert.Equal(t, c.pattern, pattern, "%s %s", c.method, c.path)
+		assert.Equal(t, c.params, params, "%s %s", c.method, c.path)
+	}
+}
+
+func TestRouterGroup(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	router.GET("/", svc)
+	admin := router.Group("/admin/")
+	admin.GET("", svc)
+	admin.GET("/users/:id", svc)
+	accounts := admin.Group("/accounts/:account")
+	accounts.POST("/close", svc)
+
+	cases := []struct {
+		method  string
+		path    string
+		pattern string
+		params  map[string]string
+	}{
+		{"GET", "/", "/", map[string]string{}},
+		{"GET", "/admin", "/admin", map[string]string{}},
+		{"GET", "/admin/users/1", "/admin/users/:id", map[string]string{"id": "1"}},
+		{"POST", "/admin/accounts/acc_1/close", "/admin/accounts/:account/close", map[string]string{"account": "acc_1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.method+c.path, func(t *testing.T) {
+			// Serving either the root or the group should dispatch to all routes
+			for _, r := range []Router{router, *admin} {
+				_, pattern, params, ok := r.Lookup(c.method, c.path)
+				require.True(t, ok)
+				assert.Equal(t, c.pattern, pattern)
+				assert.Equal(t, c.params, params)
+			}
+		})
+	}
+}
+
+func TestRouterMount(t *testing.T) {
+	t.Parallel()
+
+	type observation struct {
+		path    string
+		pattern string
+		params  map[string]string
+	}
+	var obs observation
+	observe := func(req Request) Response {
+		pattern, _ := RequestPatternFromContext(req.Context)
+		obs = observation{
+			path:    req.URL.Path,
+			pattern: pattern,
+			params:  RouterForRequest(req).Params(req)}
+		return req.Response(nil)
+	}
+
+	posts := Router{}
+	posts.GET("/", observe)
+	posts.GET("/:post", observe)
+
+	users := Router{}
+	users.GET("/:user", observe)
+	users.Mount("/:user/posts", posts.Serve())
+
+	router := Router{}
+	router.GET("/", observe)
+	router.Mount("/users", users.Serve())
+	router.Group("/v2").Mount("/users/", users.Serve())
+	router.Mount("/raw", func(req Request) Response {
+		obs = observation{path: req.URL.Path}
+		return req.Response(nil)
+	})
+
+	cases := []struct {
+		path string
+		obs  observation
+	}{
+		{"/", observation{"/", "/", map[string]string{}}},
+		{"/users/1", observation{"/1", "/users/:user", map[string]string{"user": "1"}}},
+		{"/v2/users/1", observation{"/1", "/v2/users/:user", map[string]string{"user": "1"}}},
+		{"/users/1/posts", observation{"/", "/users/:user/posts/", map[string]string{"user": "1"}}},
+		{"/users/1/posts/", observation{"/", "/users/:user/posts/", map[string]string{"user": "1"}}},
+		{"/users/1/posts/2", observation{"/2", "/users/:user/posts/:post", map[string]string{"user": "1", "post": "2"}}},
+		{"/raw", observation{path: "/"}},
+		{"/raw/a/b/", observation{path: "/a/b/"}},
+	}
+	svc := router.Serve().Filter(ErrorFilter)
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			obs = observation{}
+			req := NewRequest(context.Background(), "GET", c.path, nil)
+			rsp := svc(req)
+			require.NoError(t, rsp.Error)
+			assert.Equal(t, c.obs, obs)
+			// The outer request must not have been modified by prefix stripping
+			assert.Equal(t, c.path, req.URL.Path)
+		})
+	}
+
+	rsp := svc(NewRequest(context.Background(), "GET", "/users", nil))
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+
+	assert.Panics(t, func() {
+		router.Mount("/residual/*", observe)
+	})
+}
+
+func TestRouterFilters(t *testing.T) {
+	t.Parallel()
+
+	var trace []string
+	tracer := func(name string) Filter {
+		return func(req Request, svc Service) Response {
+			pattern, _ := RequestPatternFromContext(req.Context)
+			params := RouterForRequest(req).Params(req)
+			trace = append(trace, fmt.Sprintf("%s %s %v", name, pattern, params))
+			return svc(req)
+		}
+	}
+	svc := func(req Request) Response {
+		trace = append(trace, "svc")
+		return req.Response(nil)
+	}
+
+	router := Router{}
+	router.GET("/plain", svc)
+	router.GET("/filtered/:id", svc, tracer("route1"), tracer("route2"))
+	outer := router.Group("/outer", tracer("outer"))
+	inner := outer.Group("/inner", tracer("inner1"), tracer("inner2"))
+	inner.GET("/:id", svc, tracer("route"))
+	inner.Mount("/mount", svc, tracer("mount"))
+
+	cases := []struct {
+		path  string
+		trace []string
+	}{
+		{"/plain", []string{"svc"}},
+		{"/filtered/1", []string{
+			"route2 /filtered/:id map[id:1]",
+			"route1 /filtered/:id map[id:1]",
+			"svc"}},
+		{"/outer/inner/1", []string{
+			"outer /outer/inner/:id map[id:1]",
+			"inner2 /outer/inner/:id map[id:1]",
+			"inner1 /outer/inner/:id map[id:1]",
+			"route /outer/inner/:id map[id:1]",
+			"svc"}},
+		{"/outer/inner/mount/1", []string{
+			"outer /outer/inner/mount/* map[]",
+			"inner2 /outer/inner/mount/* map[]",
+			"inner1 /outer/inner/mount/* map[]",
+			"mount /outer/inner/mount/* map[]",
+			"svc"}},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			trace = nil
+			rsp := router.Serve()(NewRequest(context.Background(), "GET", c.path, nil))
+			require.NoError(t, rsp.Error)
+			assert.Equal(t, c.trace, trace)
+		})
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(req.Method)
+	}
+	router := Router{}
+	router.GET("/users/me", svc)
+	router.POST("/users/:id", svc)
+	router.DELETE("/users/:id", svc)
+	router.OPTIONS("/custom", svc)
+	router.HEAD("/head", svc)
+	router.GET("/head", svc)
+	router.Register("*", "/any", svc)
+	routerSvc := router.Serve().Filter(ErrorFilter)
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+		body   string
+	}{
+		{"PUT", "/users/me", http.StatusMethodNotAllowed, "DELETE, GET, HEAD, OPTIONS, POST", ""},
+		{"PUT", "/users/1", http.StatusMethodNotAllowed, "DELETE, OPTIONS, POST", ""},
+		{"OPTIONS", "/users/1", http.StatusNoContent, "DELETE, OPTIONS, POST", ""},
+		{"OPTIONS", "/custom", http.StatusOK, "", `"OPTIONS"` + "\n"},
+		{"OPTIONS", "/any", http.StatusOK, "", `"OPTIONS"` + "\n"},
+		{"OPTIONS", "/404", http.StatusNotFound, "", ""},
+		{"HEAD", "/users/me", http.StatusOK, "", ""},
+		{"HEAD", "/head", http.StatusOK, "", `"HEAD"` + "\n"},
+		{"HEAD", "/users/1", http.StatusMethodNotAllowed, "DELETE, OPTIONS, POST", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.method+c.path, func(t *testing.T) {
+			rsp := routerSvc(NewRequest(context.Background(), c.method, c.path, nil))
+			assert.Equal(t, c.status, rsp.StatusCode)
+			assert.Equal(t, c.allow, rsp.Header.Get("Allow"))
+			if c.status == http.StatusMethodNotAllowed {
+				require.Error(t, rsp.Error)
+				assert.True(t, terrors.Is(rsp.Error, ErrMethodNotAllowed))
+				return
+			}
+			if c.status < 400 {
+				require.NoError(t, rsp.Error)
+				b, err := rsp.BodyBytes(true)
+				require.NoError(t, err)
+				assert.Equal(t, c.body, string(b))
+			}
+		})
+	}
+}
+
+func TestRouterUnmatchedHandlers(t *testing.T) {
+	t.Parallel()
+
+	var info RouteInfo
+	svc := func(req Request) Response {
+		return req.Response(req.Method)
+	}
+	router := Router{
+		NotFound: func(req Request) Response {
+			info, _ = RouteInfoFromContext(req.Context)
+			rsp := NewResponseWithCode(req, http.StatusNotFound)
+			rsp.Encode(map[string]string{"path": req.URL.Path})
+			return rsp
+		},
+		MethodNotAllowed: func(req Request) Response {
+			info, _ = RouteInfoFromContext(req.Context)
+			return NewResponseWithCode(req, http.StatusMethodNotAllowed)
+		}}
+	router.GET("/users/:id", svc)
+	router.POST("/users/:id", svc)
+	router.Group("/admin").PUT("/users/:id", svc)
+
+	rsp := router.Serve()(NewRequest(context.Background(), "GET", "/nowhere", nil))
+	require.NoError(t, rsp.Error)
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	body := map[string]string{}
+	require.NoError(t, rsp.Decode(&body))
+	assert.Equal(t, map[string]string{"path": "/nowhere"}, body)
+	require.NotNil(t, info.Router)
+	assert.Equal(t, "GET", info.Method)
+	assert.Equal(t, "", info.Pattern)
+	assert.Nil(t, info.Allow)
+	require.NotNil(t, rsp.Request)
+
+	rsp = router.Serve()(NewRequest(context.Background(), "DELETE", "/users/1", nil))
+	require.NoError(t, rsp.Error)
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+	assert.Equal(t, "GET, HEAD, OPTIONS, POST", rsp.Header.Get("Allow"))
+	assert.Equal(t, []string{"GET", "HEAD", "OPTIONS", "POST"}, info.Allow)
+	assert.Equal(t, "DELETE", info.Method)
+
+	// OPTIONS requests are still answered automatically
+	rsp = router.Serve()(NewRequest(context.Background(), "OPTIONS", "/users/1", nil))
+	require.NoError(t, rsp.Error)
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+
+	// The handlers are inherited by groups, and see the parameters of any mount point
+	outer := Router{}
+	outer.Mount("/tenants/:tenant", router.Group("/admin").Serve())
+	rsp = outer.Serve()(NewRequest(context.Background(), "GET", "/tenants/acme/admin/users/1", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+	assert.Equal(t, "OPTIONS, PUT", rsp.Header.Get("Allow"))
+	assert.Equal(t, map[string]string{"tenant": "acme"}, info.Params)
+	rsp = outer.Serve()(NewRequest(context.Background(), "GET", "/tenants/acme/nowhere", nil))
+	assert.Equal(t, http.StatusNotFound, rsp.StatusCode)
+	assert.Equal(t, map[string]string{"tenant": "acme"}, info.Params)
+}
+
+func TestRouterPathCleaning(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		pattern, _ := RequestPatternFromContext(req.Context)
+		return req.Response(req.URL.Path + " " + pattern)
+	}
+	router := Router{}
+	router.GET("/users", svc)
+	router.POST("/users", svc)
+	router.GET("/users/:id/", svc)
+	router.GET("/files/*path", svc)
+
+	cases := []struct {
+		method   string
+		path     string
+		status   int
+		location string
+		body     string
+	}{
+		{"GET", "/users", http.StatusOK, "", "/users /users"},
+		{"GET", "/.//users", http.StatusMovedPermanently, "/users", "/users /users"},
+		{"GET", "/users/", http.StatusMovedPermanently, "/users", "/users /users"},
+		{"HEAD", "/users/", http.StatusMovedPermanently, "/users", ""},
+		{"POST", "/a/../users/.?x=1", http.StatusPermanentRedirect, "/users?x=1", "/users /users"},
+		{"GET", "/users/1", http.StatusMovedPermanently, "/users/1/", "/users/1/ /users/:id/"},
+		{"GET", "/users//1//", http.StatusMovedPermanently, "/users/1/", "/users/1/ /users/:id/"},
+		{"GET", "/files/a//b/../c", http.StatusMovedPermanently, "/files/a/c", "/files/a/c /files/*path"},
+		{"DELETE", "/users/", http.StatusPermanentRedirect, "/users", ""},
+		{"GET", "/nowhere//", http.StatusNotFound, "", ""},
+		{"GET", "/files/../etc/passwd", http.StatusNotFound, "", ""},
+		{"HEAD", "/files/../etc/passwd", http.StatusNotFound, "", ""},
+		{"GET", "/users/../", http.StatusNotFound, "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.method+c.path, func(t *testing.T) {
+			redirecting := router
+			redirecting.PathCleaning = RedirectCleanPath
+			req := NewRequest(context.Background(), c.method, c.path, nil)
+			rsp := redirecting.Serve().Filter(ErrorFilter)(req)
+			assert.Equal(t, c.status, rsp.StatusCode)
+			assert.Equal(t, c.location, rsp.Header.Get("Location"))
+
+			routing := router
+			routing.PathCleaning = RouteCleanPath
+			req = NewRequest(context.Background(), c.method, c.path, nil)
+			rsp = routing.Serve().Filter(ErrorFilter)(req)
+			if c.method == "HEAD" {
+				if c.location != "" {
+					assert.Equal(t, http.StatusOK, rsp.StatusCode)
+				} else {
+					assert.Equal(t, c.status, rsp.StatusCode)
+				}
+				return
+			}
+			if c.body == "" {
+				assert.NotEqual(t, http.StatusOK, rsp.StatusCode)
+				return
+			}
+			require.NoError(t, rsp.Error)
+			var body string
+			require.NoError(t, rsp.Decode(&body))
+			assert.Equal(t, c.body, body)
+		})
+	}
+
+	// Redirects from beneath a mount point are to the full path
+	inner := Router{PathCleaning: RedirectCleanPath}
+	inner.GET("/:id", svc)
+	outer := Router{}
+	outer.Mount("/tenants/:tenant/users", inner.Serve())
+	rsp := outer.Serve()(NewRequest(context.Background(), "GET", "/tenants/acme/users/1/", nil))
+	assert.Equal(t, http.StatusMovedPermanently, rsp.StatusCode)
+	assert.Equal(t, "/tenants/acme/users/1", rsp.Header.Get("Location"))
+}
+
+func TestRouterConstraints(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	router.GET("/items/:id<int>", svc)
+	router.GET("/items/:uuid<uuid>", svc)
+	router.GET("/items/:slug<re:[a-z-]+>", svc)
+	router.GET("/items/:other", svc)
+	router.GET("/codes/:code<re:[A-Z]{2,3}>.json", svc)
+	router.GET("/nested/:n<re:(?P<inner>a+)b>/end", svc)
+	router.GET("/versions/:v<re:v[0-9]+>/*rest", svc)
+
+	cases := []struct {
+		path    string
+		pattern string
+		params  map[string]string
+	}{
+		{"/items/123", "/items/:id<int>", map[string]string{"id": "123"}},
+		{"/items/-5", "/items/:id<int>", map[string]string{"id": "-5"}},
+		{"/items/99999999999999999999", "/items/:other", map[string]string{"other": "99999999999999999999"}},
+		{"/items/6ba7b810-9dad-11d1-80b4-00c04fd430c8", "/items/:uuid<uuid>",
+			map[string]string{"uuid": "6ba7b810-9dad-11d1-80b4-00c04fd430c8"}},
+		{"/items/some-slug", "/items/:slug<re:[a-z-]+>", map[string]string{"slug": "some-slug"}},
+		{"/items/Some_Thing", "/items/:other", map[string]string{"other": "Some_Thing"}},
+		{"/codes/GBP.json", "/codes/:code<re:[A-Z]{2,3}>.json", map[string]string{"code": "GBP"}},
+		{"/nested/aab/end", "/nested/:n<re:(?P<inner>a+)b>/end", map[string]string{"n": "aab"}},
+		{"/versions/v2/a/b", "/versions/:v<re:v[0-9]+>/*rest", map[string]string{"v": "v2", "rest": "a/b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			_, pattern, params, ok := router.Lookup("GET", c.path)
+			require.True(t, ok)
+			assert.Equal(t, c.pattern, pattern)
+			assert.Equal(t, c.params, params)
+		})
+	}
+
+	for _, path := range []string{"/codes/GBPX.json", "/codes/gbp.json", "/nested/b/end", "/versions/latest/a"} {
+		_, _, _, ok := router.Lookup("GET", path)
+		assert.False(t, ok, path)
+	}
+
+	for _, pattern := range []string{"/:id<float>", "/:id<re:[>", "/:id<int"} {
+		assert.Panics(t, func() {
+			router.GET(pattern, svc)
+		}, pattern)
+	}
+}
+
+func TestParamInt(t *testing.T) {
+	t.Parallel()
+
+	router := Router{}
+	router.GET("/items/:id/:name", func(req Request) Response {
+		id, err := ParamInt(req, "id")
+		if err != nil {
+			return Response{Error: err}
+		}
+		if _, err := ParamInt(req, "missing"); !terrors.Is(err, terrors.ErrInternalService) {
+			return Response{Error: fmt.Errorf("expected error for missing param, got %v", err)}
+		}
+		name, _ := Param(req, "name")
+		return req.Response(map[string]interface{}{
+			"id":   id,
+			"name": name})
+	})
+	svc := router.Serve().Filter(ErrorFilter)
+
+	rsp := svc(NewRequest(context.Background(), "GET", "/items/42/foo", nil))
+	require.NoError(t, rsp.Error)
+	body := map[string]interface{}{}
+	require.NoError(t, rsp.Decode(&body))
+	assert.Equal(t, map[string]interface{}{"id": float64(42), "name": "foo"}, body)
+
+	rsp = svc(NewRequest(context.Background(), "GET", "/items/forty-two/foo", nil))
+	require.Error(t, rsp.Error)
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrBadRequest))
+
+	_, ok := Param(NewRequest(context.Background(), "GET", "/", nil), "id")
+	assert.False(t, ok)
+}
+
+func TestRouteInfoFromContext(t *testing.T) {
+	t.Parallel()
+
+	var info RouteInfo
+	var params map[string]string
+	router := Router{}
+	router.POST("/users/:id/*rest", func(req Request) Response {
+		var ok bool
+		info, ok = RouteInfoFromContext(req.Context)
+		if !ok {
+			return Response{Error: fmt.Errorf("no route info")}
+		}
+		// The route info is captured once by Serve, so rewriting the path doesn't affect it
+		req.URL.Path = "/somewhere/else"
+		params = RouterForRequest(req).Params(req)
+		return req.Response(nil)
+	}, func(req Request, svc Service) Response {
+		u := *req.URL
+		req.URL = &u
+		return svc(req)
+	})
+	router.GET("/static", func(req Request) Response {
+		info, _ = RouteInfoFromContext(req.Context)
+		return req.Response(nil)
+	})
+
+	rsp := router.Serve()(NewRequest(context.Background(), "POST", "/users/1/a/b", nil))
+	require.NoError(t, rsp.Error)
+	assert.Equal(t, "/users/:id/*rest", info.Pattern)
+	assert.Equal(t, "POST", info.Method)
+	assert.Equal(t, map[string]string{"id": "1", "rest": "a/b"}, info.Params)
+	assert.Equal(t, info.Params, params)
+	require.NotNil(t, info.Router)
+	assert.Equal(t, router, *info.Router)
+
+	// Modifying the map returned by Params doesn't affect the route info
+	params["id"] = "2"
+	assert.Equal(t, "1", info.Params["id"])
+
+	rsp = router.Serve()(NewRequest(context.Background(), "GET", "/static", nil))
+	require.NoError(t, rsp.Error)
+	assert.Equal(t, "/static", info.Pattern)
+	assert.Nil(t, info.Params)
+
+	_, ok := RouteInfoFromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestRouterURL(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	router.GET("/", svc).Named("root")
+	router.GET("/users/:id<int>", svc).Named("user")
+	router.Group("/files").GET("/:name.json/*rest", svc).Named("file")
+	router.GET("/anon/*", svc).Named("anon")
+	route := router.POST("/users", svc)
+	assert.Equal(t, "", route.Name())
+	route = route.Named("create_user")
+	assert.Equal(t, "create_user", route.Name())
+	assert.Equal(t, "POST", route.Method())
+	assert.Equal(t, "/users", route.Pattern())
+	assert.Equal(t, "POST /users", route.String())
+
+	cases := []struct {
+		name   string
+		params map[string]string
+		path   string
+		code   string
+	}{
+		{"root", nil, "/", ""},
+		{"user", map[string]string{"id": "12", "extra": "ignored"}, "/users/12", ""},
+		{"create_user", nil, "/users", ""},
+		{"file", map[string]string{"name": "a b", "rest": "c/d?"}, "/files/a%20b.json/c/d%3F", ""},
+		{"file", map[string]string{"name": "a", "rest": ""}, "/files/a.json/", ""},
+		{"anon", nil, "/anon/", ""},
+		{"missing", nil, "", terrors.ErrInternalService},
+		{"user", nil, "", terrors.ErrInternalService},
+		{"user", map[string]string{"id": "twelve"}, "", terrors.ErrBadRequest},
+		{"file", map[string]string{"name": "a/b", "rest": ""}, "", terrors.ErrBadRequest},
+		{"file", map[string]string{"name": "", "rest": ""}, "", terrors.ErrBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s%v", c.name, c.params), func(t *testing.T) {
+			path, err := router.Path(c.name, c.params)
+			if c.code != "" {
+				require.Error(t, err)
+				assert.True(t, terrors.Is(err, c.code), err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.path, path)
+
+			// The URL should route back to the same route, with the same parameters
+			u, err := router.URL(c.name, c.params)
+			require.NoError(t, err)
+			method := "GET"
+			if c.name == "create_user" {
+				method = "POST"
+			}
+			_, pattern, params, ok := router.Lookup(method, u.Path)
+			require.True(t, ok)
+			assert.Equal(t, router.tree.names[c.name].Pattern, pattern)
+			for k, v := range params {
+				assert.Equal(t, c.params[k], v)
+			}
+		})
+	}
+
+	assert.Panics(t, func() {
+		router.GET("/other", svc).Named("user")
+	})
+	// Renaming a route frees its old name
+	route.Named("new_user")
+	_, err := router.Path("create_user", nil)
+	assert.Error(t, err)
+	router.GET("/other", svc).Named("create_user")
+}
+
+func TestRouterRoutes(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	assert.Nil(t, router.Routes())
+	router.GET("/", svc).Named("root")
+	router.Group("/users").POST("/:id", svc)
+	router.Mount("/admin", svc)
+
+	var described []string
+	for _, r := range router.Routes() {
+		described = append(described, fmt.Sprintf("%s %s %s", r.Method(), r.Pattern(), r.Name()))
+	}
+	assert.Equal(t, []string{
+		"GET / root",
+		"POST /users/:id ",
+		"* /admin ",
+		"* /admin/* "}, described)
+}
+
+func TestRouterValidate(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+
+	router := Router{}
+	router.GET("/users/me", svc)
+	router.GET("/users/:id", svc)
+	router.GET("/users/:id/*rest", svc)
+	router.GET("/items/:id<int>", svc)
+	router.GET("/items/:id<uuid>", svc)
+	router.GET("/items/:id", svc)
+	assert.NoError(t, router.Validate())
+	// The same set of routes is fine with legacy precedence, as long as they're registered in the reverse order
+	legacy := Router{LegacyPrecedence: true}
+	legacy.GET("/users/:id/*rest", svc)
+	legacy.GET("/users/:id", svc)
+	legacy.GET("/users/me", svc)
+	assert.NoError(t, legacy.Validate())
+
+	router.POST("/users/:id", svc)
+	router.Register("*", "/users/:user", svc)
+	router.GET("/items/:slug<re:[a-z]+>", svc)
+	router.GET("/items/:slug<re:[0-9]+>/x", svc)
+	err := router.Validate()
+	require.Error(t, err)
+	assert.Equal(t, "route GET /users/:id is shadowed by * /users/:user\n"+
+		"routes GET /items/:id<int> and GET /items/:slug<re:[a-z]+> are ambiguous\n"+
+		"routes GET /items/:id<int> and GET /items/:slug<re:[0-9]+>/x are ambiguous\n"+
+		"routes GET /items/:id<uuid> and GET /items/:slug<re:[a-z]+> are ambiguous\n"+
+		"routes GET /items/:id<uuid> and GET /items/:slug<re:[0-9]+>/x are ambiguous\n"+
+		"route POST /users/:id is shadowed by * /users/:user\n"+
+		"routes GET /items/:slug<re:[a-z]+> and GET /items/:slug<re:[0-9]+>/x are ambiguous", err.Error())
+
+	legacy.GET("/users/*rest", svc)
+	err = legacy.Validate()
+	require.Error(t, err)
+	assert.Equal(t, "route GET /users/:id/*rest is shadowed by GET /users/*rest\n"+
+		"route GET /users/:id is shadowed by GET /users/*rest\n"+
+		"route GET /users/me is shadowed by GET /users/*rest", err.Error())
+}
+
+func TestRouterRouteTableService(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	router.GET("/users/:id", svc).Named("user")
+	router.GET("/users/:user", svc)
+	router.GET("/_routes", router.RouteTableService())
+
+	rsp := router.Serve()(NewRequest(context.Background(), "GET", "/_routes", nil))
+	require.NoError(t, rsp.Error)
+	b, err := rsp.BodyBytes(true)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"routes": [
+			{"method": "GET", "pattern": "/users/:id", "name": "user"},
+			{"method": "GET", "pattern": "/users/:user"},
+			{"method": "GET", "pattern": "/_routes"}
+		],
+		"problems": ["route GET /users/:id is shadowed by GET /users/:user"]
+	}`, string(b))
+}
+
+func TestRouterPredicates(t *testing.T) {
+	t.Parallel()
+
+	named := func(name string) Service {
+		return func(req Request) Response {
+			info, _ := RouteInfoFromContext(req.Context)
+			return req.Response(map[string]interface{}{
+				"name":    name,
+				"pattern": info.Pattern,
+				"params":  info.Params})
+		}
+	}
+	router := Router{}
+	router.GET("/users/:id", named("default"))
+	router.GET("/users/:id", named("v2")).Header("x-api-version", "2")
+	router.GET("/users/:id", named("json")).HeaderRegexp("Accept", `^application/json\b`)
+	router.GET("/users/:id", named("debug")).Header("X-API-Version", "2").Query("debug")
+	router.GET("/users/:id", named("tenant")).Host(":tenant<re:[a-z]+>.Example.com")
+	router.POST("/users/:id", named("admin")).Host("admin.example.com")
+	router.GET("/users/me", named("me"))
+	router.GET("/*path", named("catchall")).Host("static.example.com")
+
+	cases := []struct {
+		method, target string
+		host           string
+		header         http.Header
+		name           string
+		pattern        string
+		params         map[string]string
+	}{
+		{"GET", "/users/1", "", nil, "default", "/users/:id", map[string]string{"id": "1"}},
+		{"GET", "/users/1", "", http.Header{"X-Api-Version": {"1", "2"}}, "v2", "/users/:id", map[string]string{"id": "1"}},
+		{"GET", "/users/1", "", http.Header{"Accept": {"application/json; q=0.9"}}, "json", "/users/:id", map[string]string{"id": "1"}},
+		{"GET", "/users/1?debug", "", http.Header{"X-Api-Version": {"2"}}, "debug", "/users/:id", map[string]string{"id": "1"}},
+		{"GET", "/users/1?debug", "", nil, "default", "/users/:id", map[string]string{"id": "1"}},
+		{"GET", "/users/1", "acme.example.com:8080", nil, "tenant", ":tenant<re:[a-z]+>.Example.com/users/:id", map[string]string{"id": "1", "tenant": "acme"}},
+		{"GET", "/users/1", "ACME.EXAMPLE.COM.", nil, "tenant", ":tenant<re:[a-z]+>.Example.com/users/:id", map[string]string{"id": "1", "tenant": "acme"}},
+		{"GET", "/users/1", "acme1.example.com", nil, "default", "/users/:id", map[string]string{"id": "1"}},
+		// Paths take precedence over other conditions
+		{"GET", "/users/me", "acme.example.com", nil, "me", "/users/me", nil},
+		{"GET", "/users/me", "static.example.com", nil, "me", "/users/me", nil},
+		{"GET", "/other", "static.example.com", nil, "catchall", "static.example.com/*path", map[string]string{"path": "other"}},
+		{"POST", "/users/1", "admin.example.com", nil, "admin", "admin.example.com/users/:id", map[string]string{"id": "1"}},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s%s%s%v", c.host, c.method, c.target, c.header), func(t *testing.T) {
+			req := NewRequest(context.Background(), c.method, c.target, nil)
+			req.Host = c.host
+			for k, v := range c.header {
+				req.Header[k] = v
+			}
+			rsp := router.Serve()(req)
+			require.NoError(t, rsp.Error)
+			body := struct {
+				Name    string            `json:"name"`
+				Pattern string            `json:"pattern"`
+				Params  map[string]string `json:"params"`
+			}{}
+			require.NoError(t, rsp.Decode(&body))
+			assert.Equal(t, c.name, body.Name)
+			assert.Equal(t, c.pattern, body.Pattern)
+			assert.Equal(t, c.params, body.Params)
+			assert.Equal(t, c.pattern, router.Pattern(req))
+			if c.params != nil {
+				assert.Equal(t, c.params, router.Params(req))
+			}
+		})
+	}
+
+	// Routes whose conditions aren't satisfied don't contribute to the allowed methods
+	rsp := router.Serve()(NewRequest(context.Background(), "POST", "/other", nil))
+	assert.True(t, terrors.Is(rsp.Error, terrors.ErrNotFound))
+	req := NewRequest(context.Background(), "DELETE", "/users/1", nil)
+	req.Host = "admin.example.com"
+	rsp = router.Serve()(req)
+	assert.True(t, terrors.Is(rsp.Error, ErrMethodNotAllowed))
+	assert.Equal(t, "GET, HEAD, OPTIONS, POST", rsp.Header.Get("Allow"))
+
+	// Lookup has no request, so it ignores routes with conditions
+	_, pattern, _, ok := router.Lookup("POST", "/users/1")
+	assert.False(t, ok)
+	_, pattern, _, ok = router.Lookup("GET", "/users/1")
+	assert.True(t, ok)
+	assert.Equal(t, "/users/:id", pattern)
+
+	assert.Panics(t, func() {
+		router.GET("/x", named("x")).Host("")
+	})
+	assert.Panics(t, func() {
+		router.GET("/x", named("x")).HeaderRegexp("Accept", "(")
+	})
+}
+
+func TestRouterPredicatesURL(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	route := router.GET("/users/:id", svc).Host(":tenant.example.com").Header("X-Api-Version", "2").Named("user")
+	assert.Equal(t, ":tenant.example.com/users/:id", route.Pattern())
+	assert.Equal(t, "GET :tenant.example.com/users/:id [X-Api-Version: 2]", route.String())
+
+	u, err := router.URL("user", map[string]string{"tenant": "acme", "id": "1"})
+	require.NoError(t, err)
+	assert.Equal(t, "acme.example.com", u.Host)
+	assert.Equal(t, "/users/1", u.Path)
+	_, err = router.URL("user", map[string]string{"tenant": "acme.evil", "id": "1"})
+	assert.True(t, terrors.Is(err, terrors.ErrBadRequest))
+}
+
+func TestRouterPredicatesValidate(t *testing.T) {
+	t.Parallel()
+
+	svc := func(req Request) Response {
+		return req.Response(nil)
+	}
+	router := Router{}
+	router.GET("/users/:id", svc)
+	router.GET("/users/:id", svc).Host("a.example.com")
+	router.GET("/users/:id", svc).Host("b.example.com")
+	router.GET("/users/:id", svc).Header("X-Api-Version", "2").Query("debug")
+	router.GET("/users/:id", svc).Header("X-Api-Version", "3").Query("debug")
+	assert.NoError(t, router.Validate())
+
+	router.GET("/users/:user", svc).Host("a.example.com")
+	router.GET("/users/:id", svc).Query("verbose")
+	err := router.Validate()
+	require.Error(t, err)
+	assert.Equal(t, "route GET a.example.com/users/:id is shadowed by GET a.example.com/users/:user\n"+
+		"routes GET a.example.com/users/:id and GET /users/:id [?verbose] are ambiguous\n"+
+		"routes GET b.example.com/users/:id and GET /users/:id [?verbose] are ambiguous\n"+
+		"routes GET a.example.com/users/:user and GET /users/:id [?verbose] are ambiguous", err.Error())
+
+	// With legacy precedence, a route is shadowed by a later one with fewer conditions
+	legacy := Router{LegacyPrecedence: true}
+	legacy.GET("/users/:id", svc).Header("X-Api-Version", "2").Query("debug")
+	legacy.GET("/users/:id", svc).Host("a.example.com")
+	legacy.GET("/users/:id", svc).Query("debug")
+	err = legacy.Validate()
+	require.Error(t, err)
+	assert.Equal(t, "route GET /users/:id [X-Api-Version: 2, ?debug] is shadowed by GET /users/:id [?debug]", err.Error())
+}
@@ -0,0 +1,513 @@
+package typhon
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type routerSegmentKind int
+
+const (
+	staticSegment routerSegmentKind = iota
+	paramSegment
+	residualSegment
+)
+
+// A routerSegment is one /-delimited component of a compiled pattern.
+type routerSegment struct {
+	kind       routerSegmentKind
+	text       string // literal text for static segments, or the (possibly empty) name of a parameter or residual
+	suffix     string // literal text following a parameter or residual within the same component
+	constraint *routerConstraint
+}
+
+// key identifies the segment structurally. Parameter names are deliberately excluded so that patterns which differ
+// only by the names of their parameters share nodes in the tree.
+func (s routerSegment) key() string {
+	switch s.kind {
+	case paramSegment:
+		if s.constraint != nil {
+			return ":<" + s.constraint.spec + ">" + s.suffix
+		}
+		return ":" + s.suffix
+	case residualSegment:
+		return "*" + s.suffix
+	default:
+		return s.text
+	}
+}
+
+// moreSpecific reports whether the segment is strictly more specific than other, and so should be tried before it.
+// Segments with a longer literal suffix are more specific, followed by those with a constraint.
+func (s routerSegment) moreSpecific(other routerSegment) bool {
+	if len(s.suffix) != len(other.suffix) {
+		return len(s.suffix) > len(other.suffix)
+	}
+	return s.constraint != nil && other.constraint == nil
+}
+
+// A routerConstraint restricts the values a parameter will match, like :id<int>.
+type routerConstraint struct {
+	spec  string // as written in the pattern, between the angle brackets
+	match func(string) bool
+}
+
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func newRouterConstraint(spec string) (*routerConstraint, error) {
+	c := &routerConstraint{spec: spec}
+	switch {
+	case spec == "int":
+		c.match = func(v string) bool {
+			_, err := strconv.ParseInt(v, 10, 64)
+			return err == nil
+		}
+	case spec == "uuid":
+		c.match = uuidRe.MatchString
+	case strings.HasPrefix(spec, "re:"):
+		re, err := regexp.Compile(`^(?:` + spec[len("re:"):] + `)$`)
+		if err != nil {
+			return nil, err
+		}
+		c.match = re.MatchString
+	default:
+		return nil, fmt.Errorf("unknown constraint %#v", spec)
+	}
+	return c, nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isParamName(s string) bool {
+	if len(s) < 2 || s[0] != ':' {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitPattern splits a pattern into its components delimited by sep, ignoring any separators within constraints.
+func splitPattern(pattern string, sep byte) []string {
+	var components []string
+	start, depth := 0, 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case sep:
+			if depth == 0 {
+				components = append(components, pattern[start:i])
+				start = i + 1
+			}
+		case '<':
+			// Angle brackets open a constraint only directly after a parameter name, but may nest within it
+			if depth > 0 || isParamName(pattern[start:i]) {
+				depth++
+			}
+		case '>':
+			if depth > 0 {
+				depth--
+			}
+		}
+	}
+	return append(components, pattern[start:])
+}
+
+// parseRouterSegment parses a single component of a pattern. A component which begins with :name is a parameter,
+// which may be followed by a constraint like :name<int>, and one which begins with * or *name is a residual; anything
+// else is matched literally.
+func parseRouterSegment(component string) (routerSegment, error) {
+	if len(component) == 0 {
+		return routerSegment{kind: staticSegment}, nil
+	}
+	switch component[0] {
+	case ':', '*':
+		i := 1
+		for i < len(component) && isWordByte(component[i]) {
+			i++
+		}
+		if component[0] == '*' {
+			return routerSegment{kind: residualSegment, text: component[1:i], suffix: component[i:]}, nil
+		}
+		if i == 1 { // a colon not followed by a name is just a colon
+			break
+		}
+		s := routerSegment{kind: paramSegment, text: component[1:i], suffix: component[i:]}
+		if strings.HasPrefix(s.suffix, "<") {
+			end := 0
+			for depth := 0; end < len(s.suffix); end++ {
+				if s.suffix[end] == '<' {
+					depth++
+				} else if s.suffix[end] == '>' {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+			if end == len(s.suffix) {
+				return s, fmt.Errorf("unterminated constraint on parameter %#v", s.text)
+			}
+			c, err := newRouterConstraint(s.suffix[1:end])
+			if err != nil {
+				return s, fmt.Errorf("bad constraint on parameter %#v: %w", s.text, err)
+			}
+			s.constraint, s.suffix = c, s.suffix[end+1:]
+		}
+		return s, nil
+	}
+	return routerSegment{kind: staticSegment, text: component}, nil
+}
+
+// A routerNode is a node within a Router's tree. Each level of the tree corresponds to a /-delimited component of the
+// path, and a node's children are held separately by kind so that they can be tried in order of precedence.
+type routerNode struct {
+	segment   routerSegment
+	static    map[string]*routerNode
+	params    []*routerNode
+	residuals []*routerNode
+	entries   []*routerEntry // routes whose patterns terminate at this node, in order of registration
+}
+
+// child returns the child of the node which matches the passed segment, creating it if necessary.
+func (n *routerNode) child(s routerSegment) *routerNode {
+	if s.kind == staticSegment {
+		if c, ok := n.static[s.text]; ok {
+			return c
+		}
+		if n.static == nil {
+			n.static = make(map[string]*routerNode)
+		}
+		c := &routerNode{segment: s}
+		n.static[s.text] = c
+		return c
+	}
+
+	siblings := &n.params
+	if s.kind == residualSegment {
+		siblings = &n.residuals
+	}
+	var c *routerNode
+	for i, sibling := range *siblings {
+		if sibling.segment.key() == s.key() {
+			c = sibling
+			*siblings = slices.Delete(*siblings, i, i+1)
+			break
+		}
+	}
+	if c == nil {
+		c = &routerNode{segment: routerSegment{kind: s.kind, suffix: s.suffix, constraint: s.constraint}}
+	}
+	// Siblings are kept in order of specificity, and otherwise in reverse order of the latest registration beneath them,
+	// so that where they are equally specific the route registered last takes precedence
+	i := 0
+	for i < len(*siblings) && (*siblings)[i].segment.moreSpecific(s) {
+		i++
+	}
+	*siblings = slices.Insert(*siblings, i, c)
+	return c
+}
+
+// A routerTree holds the compiled routes of a Router.
+type routerTree struct {
+	root    routerNode
+	seq     int            // incremented for each registration; used to break ties in favour of later routes
+	entries []*routerEntry // in order of registration
+	names   map[string]*routerEntry
+}
+
+func (t *routerTree) insert(e *routerEntry) {
+	t.seq++
+	e.seq = t.seq
+	for _, s := range e.segments {
+		e.named = e.named || (s.kind != staticSegment && s.text != "")
+	}
+	t.place(e)
+	t.entries = append(t.entries, e)
+}
+
+// place adds a registered entry to the node at which its pattern terminates.
+func (t *routerTree) place(e *routerEntry) {
+	n := &t.root
+	for _, s := range e.segments {
+		n = n.child(s)
+	}
+	n.entries = append(n.entries, e)
+}
+
+// snapshot returns a copy of the tree, which is unaffected by routes registered in the tree subsequently. The tree may
+// be nil, in which case the snapshot is empty.
+func (t *routerTree) snapshot() *routerTree {
+	if t == nil {
+		return &routerTree{}
+	}
+	s := &routerTree{
+		seq:     t.seq,
+		entries: slices.Clone(t.entries),
+		names:   maps.Clone(t.names)}
+	for _, e := range t.entries {
+		s.place(e)
+	}
+	return s
+}
+
+// nextComponent returns the end offset of the component delimited by sep which starts at pos.
+func nextComponent(s string, pos int, sep byte) int {
+	if end := strings.IndexByte(s[pos:], sep); end >= 0 {
+		return pos + end
+	}
+	return len(s)
+}
+
+// capture returns the value captured by a parameter or residual segment from the passed text, and whether the segment
+// matches it at all. Parameters must capture something; residuals may capture nothing.
+func (s routerSegment) capture(text string) (string, bool) {
+	if !strings.HasSuffix(text, s.suffix) || (s.kind == paramSegment && len(text) <= len(s.suffix)) {
+		return "", false
+	}
+	value := text[:len(text)-len(s.suffix)]
+	if s.constraint != nil && !s.constraint.match(value) {
+		return "", false
+	}
+	return value, true
+}
+
+// A routerMatcher holds the state of a single lookup as it walks the tree.
+type routerMatcher struct {
+	method string
+	path   string
+	req    *Request     // the request being routed, if any, against which route predicates are evaluated
+	legacy bool         // if set, every matching route is considered and the last registered wins
+	entry  *routerEntry // the best route found so far
+	allow  []string     // methods of routes which matched the path but not the method
+}
+
+// match walks the tree from node n, where pos is the offset within the path of the next component to be consumed (or
+// is beyond the end of the path if there are no more components). It returns true when the search is complete.
+func (m *routerMatcher) match(n *routerNode, pos int) bool {
+	if pos > len(m.path) {
+		return m.visit(n)
+	}
+	end := nextComponent(m.path, pos, '/')
+	component := m.path[pos:end]
+
+	// Static components take precedence over parameters, which take precedence over residuals
+	if c, ok := n.static[component]; ok {
+		if m.match(c, end+1) {
+			return true
+		}
+	}
+	for _, c := range n.params {
+		if _, ok := c.segment.capture(component); ok && m.match(c, end+1) {
+			return true
+		}
+	}
+	for _, c := range n.residuals {
+		// Residuals are non-greedy: they consume as few components as possible (but at least one)
+		for e := end; ; e = nextComponent(m.path, e+1, '/') {
+			if _, ok := c.segment.capture(m.path[pos:e]); ok && m.match(c, e+1) {
+				return true
+			}
+			if e >= len(m.path) {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// visit considers the routes which terminate at a node that the whole path has matched. It returns true when the
+// search is complete.
+func (m *routerMatcher) visit(n *routerNode) bool {
+	found := false
+	for i := len(n.entries) - 1; i >= 0; i-- { // iterate in reverse to prefer routes registered later
+		e := n.entries[i]
+		if !e.matches(m.req) {
+			continue
+		}
+		if e.Method != m.method && e.Method != "*" {
+			if m.entry == nil { // allowed methods are only of interest if no route matches
+				m.allow = append(m.allow, e.Method)
+			}
+			continue
+		}
+		if m.entry == nil || m.prefer(e) {
+			m.entry = e
+		}
+		found = true
+	}
+	return found && !m.legacy
+}
+
+// prefer reports whether e takes precedence over the best route found so far. Within a node, routes with more
+// conditions are preferred, and then those registered later; with legacy precedence, only the order of registration
+// counts.
+func (m *routerMatcher) prefer(e *routerEntry) bool {
+	if !m.legacy && e.specificity() != m.entry.specificity() {
+		return e.specificity() > m.entry.specificity()
+	}
+	return e.seq > m.entry.seq
+}
+
+// extract populates params (if non-nil) with the values of the named parameters and residuals within segments, as
+// matched against the components of str delimited by sep, from offset pos. Residuals capture as little as possible, so
+// the result is deterministic even where there are several ways for str to match. It returns false if str does not
+// match.
+func extract(segments []routerSegment, str string, sep byte, pos int, params map[string]string) bool {
+	if len(segments) == 0 || pos > len(str) {
+		return len(segments) == 0 && pos > len(str)
+	}
+	s, end := segments[0], nextComponent(str, pos, sep)
+
+	switch s.kind {
+	case staticSegment:
+		return str[pos:end] == s.text && extract(segments[1:], str, sep, end+1, params)
+	case paramSegment:
+		value, ok := s.capture(str[pos:end])
+		if !ok || !extract(segments[1:], str, sep, end+1, params) {
+			return false
+		}
+		if params != nil && s.text != "" {
+			params[s.text] = value
+		}
+		return true
+	}
+
+	for e := end; ; e = nextComponent(str, e+1, sep) {
+		if value, ok := s.capture(str[pos:e]); ok && extract(segments[1:], str, sep, e+1, params) {
+			if params != nil && s.text != "" {
+				params[s.text] = value
+			}
+			return true
+		}
+		if e >= len(str) {
+			return false
+		}
+	}
+}
+
+// compileSegments parses a pattern whose components are delimited by sep.
+func compileSegments(pattern string, sep byte) ([]routerSegment, error) {
+	components := splitPattern(pattern, sep)
+	segments := make([]routerSegment, len(components))
+	for i, c := range components {
+		s, err := parseRouterSegment(c)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = s
+	}
+	return segments, nil
+}
+
+// sameShape reports whether two patterns are structurally identical (ie. they differ at most in the names of their
+// parameters), and so match exactly the same paths.
+func sameShape(a, b []routerSegment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].kind != b[i].kind || a[i].key() != b[i].key() {
+			return false
+		}
+	}
+	return true
+}
+
+// covers reports whether pattern b is certain to match every path that pattern a matches. It errs on the side of
+// caution, so it may report false for some patterns which do cover others.
+func covers(b, a []routerSegment) bool {
+	if len(b) == 0 || len(a) == 0 {
+		return len(b) == 0 && len(a) == 0
+	}
+	if b[0].kind == a[0].kind && b[0].key() == a[0].key() {
+		return covers(b[1:], a[1:])
+	}
+
+	switch b[0].kind {
+	case paramSegment:
+		switch a[0].kind {
+		case staticSegment:
+			_, ok := b[0].capture(a[0].text)
+			return ok && covers(b[1:], a[1:])
+		case paramSegment:
+			return b[0].suffix == "" && b[0].constraint == nil && covers(b[1:], a[1:])
+		}
+	case residualSegment:
+		if b[0].suffix != "" {
+			return false
+		}
+		// A bare residual consumes one or more components, so it covers any number of segments
+		for k := 1; k <= len(a); k++ {
+			if covers(b[1:], a[k:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ambiguous reports whether the order in which two patterns are tried depends only on the order of their registration,
+// and they may match some of the same paths. This is the case when the patterns first diverge at parameters with
+// different constraints which may overlap.
+func ambiguous(a, b []routerSegment) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].kind == b[i].kind && a[i].key() == b[i].key() {
+			continue
+		}
+		if a[i].kind != paramSegment || b[i].kind != paramSegment || a[i].suffix != b[i].suffix {
+			return false
+		}
+		ca, cb := a[i].constraint, b[i].constraint
+		if ca == nil || cb == nil {
+			return false
+		}
+		// Integers and UUIDs are the only constraints known to be disjoint
+		return strings.HasPrefix(ca.spec, "re:") || strings.HasPrefix(cb.spec, "re:")
+	}
+	return false
+}
+
+// subset reports whether every element of the sorted slice a is also in the sorted slice b.
+func subset(a, b []string) bool {
+	for _, x := range a {
+		if _, ok := slices.BinarySearch(b, x); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// disjoint reports whether the conditions of two routes are certain to be mutually exclusive: either because they have
+// different literal host patterns, or because they require different values of the same header.
+func disjoint(a, b *routerEntry) bool {
+	if literal(a.hostSegments) && literal(b.hostSegments) && a.Host != "" && b.Host != "" &&
+		!strings.EqualFold(a.Host, b.Host) {
+		return true
+	}
+	for _, pa := range a.predicates {
+		for _, pb := range b.predicates {
+			if pa.header != "" && pa.header == pb.header && pa.re == nil && pb.re == nil && pa.value != pb.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// literal reports whether segments contains only static components.
+func literal(segments []routerSegment) bool {
+	for _, s := range segments {
+		if s.kind != staticSegment {
+			return false
+		}
+	}
+	return true
+}
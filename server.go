@@ -2,12 +2,15 @@ package typhon
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,18 +18,54 @@ import (
 )
 
 type Server struct {
-	l            net.Listener
+	ls           []net.Listener
 	srv          *http.Server
 	shuttingDown chan struct{}
 	shutdownOnce sync.Once
+	preStopDelay time.Duration
+	hookTimeout  time.Duration
+	hooksM       sync.Mutex
+	hooks        map[ShutdownPhase][]func(context.Context) error
+	stopErr      error
 }
 
+// A ShutdownPhase is a point during Server.Stop at which shutdown hooks are run (see Server.OnShutdown).
+type ShutdownPhase int
+
+const (
+	// ShutdownBeforeDrain hooks run once the server has begun to shut down, but before it stops accepting connections
+	// and drains those which are open.
+	ShutdownBeforeDrain ShutdownPhase = iota
+	// ShutdownAfterDrain hooks run once all connections have been closed.
+	ShutdownAfterDrain
+)
+
+func (p ShutdownPhase) String() string {
+	switch p {
+	case ShutdownBeforeDrain:
+		return "before-drain"
+	case ShutdownAfterDrain:
+		return "after-drain"
+	default:
+		return fmt.Sprintf("ShutdownPhase(%d)", int(p))
+	}
+}
+
+// defaultShutdownHookTimeout is the time each shutdown hook may take, unless set by WithShutdownHookTimeout.
+const defaultShutdownHookTimeout = 10 * time.Second
+
 // ServerOption allows customizing the underling http.Server
 type ServerOption func(*Server)
 
-// Listener returns the network listener that this server is active on.
+// Listener returns the network listener that this server is active on. If it is active on several, it returns the
+// first.
 func (s *Server) Listener() net.Listener {
-	return s.l
+	return s.ls[0]
+}
+
+// Listeners returns the network listeners that this server is active on.
+func (s *Server) Listeners() []net.Listener {
+	return slices.Clone(s.ls)
 }
 
 // Done returns a channel that will be closed when the server begins to shutdown. The server may still be draining its
@@ -35,29 +74,89 @@ func (s *Server) Done() <-chan struct{} {
 	return s.shuttingDown
 }
 
+// OnShutdown registers a hook to be run during the given phase of Stop: for example to stop background workers before
+// connections are drained, or to flush buffers and close downstream connection pools afterwards. Within each phase,
+// hooks are run one at a time in the order they were registered, and any errors they return are returned from Stop.
+//
+// Each hook's context expires after a timeout (see WithShutdownHookTimeout). Hooks which run before draining are also
+// bounded by the context passed to Stop; those which run afterwards are not, so that they can clean up even if
+// draining took until it expired.
+func (s *Server) OnShutdown(phase ShutdownPhase, hook func(ctx context.Context) error) {
+	s.hooksM.Lock()
+	defer s.hooksM.Unlock()
+	if s.hooks == nil {
+		s.hooks = make(map[ShutdownPhase][]func(context.Context) error)
+	}
+	s.hooks[phase] = append(s.hooks[phase], hook)
+}
+
+// runHooks runs the hooks registered for a phase, returning their errors.
+func (s *Server) runHooks(ctx context.Context, phase ShutdownPhase) []error {
+	s.hooksM.Lock()
+	hooks := s.hooks[phase]
+	s.hooksM.Unlock()
+
+	var errs []error
+	for i, hook := range hooks {
+		hookCtx, cancel := context.WithTimeout(ctx, s.hookTimeout)
+		err := hook(hookCtx)
+		cancel()
+		if err != nil {
+			slog.Error(ctx, "Shutdown hook %d (%v) failed: %v", i, phase, err)
+			errs = append(errs, fmt.Errorf("%v shutdown hook %d: %w", phase, i, err))
+		}
+	}
+	return errs
+}
+
 // Stop shuts down the server, returning when there are no more connections still open. Graceful shutdown will be
 // attempted until the passed context expires, at which time all connections will be forcibly terminated.
-func (s *Server) Stop(ctx context.Context) {
+//
+// Shutdown hooks (see OnShutdown) are run before and after the connections are drained. Stop returns the errors of any
+// hooks which failed, along with any error forcibly closing the connections. Subsequent calls return the same error.
+func (s *Server) Stop(ctx context.Context) error {
 	s.shutdownOnce.Do(func() {
 		close(s.shuttingDown)
+		errs := s.runHooks(ctx, ShutdownBeforeDrain)
+		if s.preStopDelay > 0 {
+			t := time.NewTimer(s.preStopDelay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+			}
+		}
 		// Gracefully shut down the HTTP server, draining in-flight requests until the context
 		// expires. Since Go 1.24 this drains h2c connections just like HTTP/1.1 ones, so no bespoke
 		// connection tracking is required (see H2cFilter).
 		if err := s.srv.Shutdown(ctx); err != nil {
 			slog.Debug(ctx, "Graceful shutdown failed; forcibly closing connections 👢")
 			if err := s.srv.Close(); err != nil {
-				slog.Critical(ctx, "Forceful shutdown failed, exiting 😱: %v", err)
-				panic(err) // Something is super hosed here
+				slog.Critical(ctx, "Forceful shutdown failed 😱: %v", err)
+				errs = append(errs, fmt.Errorf("forceful shutdown: %w", err))
 			}
 		}
+		errs = append(errs, s.runHooks(context.WithoutCancel(ctx), ShutdownAfterDrain)...)
+		s.stopErr = errors.Join(errs...)
 	})
+	return s.stopErr
 }
 
 // Serve starts a HTTP server, binding the passed Service to the passed listener and applying the passed ServerOptions.
 func Serve(svc Service, l net.Listener, opts ...ServerOption) (*Server, error) {
+	return ServeListeners(svc, []net.Listener{l}, opts...)
+}
+
+// ServeListeners is like Serve, but binds the Service to several listeners at once (eg. a public TCP listener, and a
+// Unix socket for administration.) They are shut down together when the server is stopped.
+func ServeListeners(svc Service, ls []net.Listener, opts ...ServerOption) (*Server, error) {
+	if len(ls) == 0 {
+		return nil, errors.New("typhon: no listeners to serve")
+	}
 	s := &Server{
-		l:            l,
-		shuttingDown: make(chan struct{})}
+		ls:           slices.Clone(ls),
+		shuttingDown: make(chan struct{}),
+		hookTimeout:  defaultShutdownHookTimeout}
 
 	// Enable HTTP/1.1, TLS HTTP/2, and unencrypted HTTP/2 (h2c, prior knowledge). Since Go 1.24
 	// net/http supports h2c natively, so we no longer need golang.org/x/net/http2/h2c and its
@@ -84,19 +183,27 @@ func Serve(svc Service, l net.Listener, opts ...ServerOption) (*Server, error) {
 		opt(s)
 	}
 
-	go func() {
-		err := s.srv.Serve(l)
-		if err != nil && err != http.ErrServerClosed {
-			slog.Error(nil, "HTTP server error: %v", err)
-			// Stopping with an already-closed context means we go immediately to "forceful" mode
-			ctx, cancel := context.WithCancel(context.Background())
-			cancel()
-			s.Stop(ctx)
-		}
-	}()
+	for _, l := range s.ls {
+		go func(l net.Listener) {
+			err := s.srv.Serve(l)
+			if err != nil && err != http.ErrServerClosed {
+				slog.Error(nil, "HTTP server error: %v", err)
+				// Stopping with an already-closed context means we go immediately to "forceful" mode
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				s.Stop(ctx)
+			}
+		}(l)
+	}
 	return s, nil
 }
 
+// Listen starts a HTTP server listening on the passed address, binding it to the passed Service and applying the
+// passed ServerOptions.
+//
+// The address may be a TCP address (like "localhost:8080"), or a URL with a tcp, tcp4, tcp6 or unix scheme (like
+// "tcp://:8080" or "unix:///var/run/service.sock"). If it is empty, the LISTEN_ADDR or PORT environment variables are
+// used instead.
 func Listen(svc Service, addr string, opts ...ServerOption) (*Server, error) {
 	// Determine on which address to listen, choosing in order one of:
 	// 1. The passed addr
@@ -111,16 +218,31 @@ func Listen(svc Service, addr string, opts ...ServerOption) (*Server, error) {
 			addr = ":0"
 		}
 	}
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	l, err := NewListener(addr)
 	if err != nil {
 		return nil, err
 	}
+	return Serve(svc, l, opts...)
+}
 
-	l, err := net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		return nil, err
+// NewListener returns a listener for an address in any of the forms accepted by Listen, for use with ServeListeners.
+func NewListener(addr string) (net.Listener, error) {
+	network := "tcp"
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		network, addr = scheme, rest
+	}
+	switch network {
+	case "unix":
+		return net.Listen("unix", addr)
+	case "tcp", "tcp4", "tcp6":
+		tcpAddr, err := net.ResolveTCPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return net.ListenTCP(network, tcpAddr)
+	default:
+		return nil, fmt.Errorf("typhon: unsupported network %q in listen address", network)
 	}
-	return Serve(svc, l, opts...)
 }
 
 // TimeoutOptions specifies various server timeouts. See http.Server for details of what these do.
@@ -142,6 +264,22 @@ func WithTimeout(opts TimeoutOptions) ServerOption {
 	}
 }
 
+// WithShutdownHookTimeout sets the time each shutdown hook (see Server.OnShutdown) may take. Defaults to 10 seconds.
+func WithShutdownHookTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.hookTimeout = d
+	}
+}
+
+// WithPreStopDelay delays the shutdown of the server's listener and connections when Stop is called, so that load
+// balancers have time to notice that it is draining (eg. via Done, or a Health's readiness) and stop sending it
+// traffic. The delay ends early if Stop's context is done.
+func WithPreStopDelay(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.preStopDelay = d
+	}
+}
+
 var (
 	connectionStartTimeHeaderKey = "X-Typhon-Connection-Start"
 	// addConnectionStartTimeHeader is set to true within tests to